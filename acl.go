@@ -0,0 +1,70 @@
+package mirror2s3
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// aclFor returns the canned ACL for the object at key, or "" to leave it to
+// the bucket.
+func (m *Mirror) aclFor(key string) string {
+	ext := strings.ToLower(path.Ext(key))
+	if acl, ok := m.aclByExtension[ext]; ok {
+		return acl
+	}
+	return m.acl
+}
+
+// cannedACL returns a BeforeWrite function that sets the written object's
+// canned ACL.
+func cannedACL(acl string) func(func(interface{}) bool) error {
+	return func(as func(interface{}) bool) error {
+		var in *s3manager.UploadInput
+		if !as(&in) {
+			return errors.New("ACLs are only supported by S3")
+		}
+		in.ACL = aws.String(acl)
+		return nil
+	}
+}
+
+// noContentType is a BeforeWrite function that keeps the written object from
+// getting the content type the blob package sniffs from its contents. Buckets
+// other than S3 get the sniffed type.
+func noContentType(as func(interface{}) bool) error {
+	var in *s3manager.UploadInput
+	if as(&in) {
+		in.ContentType = nil
+	}
+	return nil
+}
+
+// beforeWrite returns the BeforeWrite function for uploading f, or nil if it
+// doesn't need one.
+func (m *Mirror) beforeWrite(f *file) func(func(interface{}) bool) error {
+	var fns []func(func(interface{}) bool) error
+	if m.noContentType {
+		fns = append(fns, noContentType)
+	}
+	if f.redirect != "" {
+		fns = append(fns, websiteRedirect(f.redirect))
+	}
+	if f.acl != "" {
+		fns = append(fns, cannedACL(f.acl))
+	}
+	if len(fns) == 0 {
+		return nil
+	}
+	return func(as func(interface{}) bool) error {
+		for _, fn := range fns {
+			if err := fn(as); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,105 @@
+package mirror2s3
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ArchiveFormat is a format for git archive to write the site in.
+type ArchiveFormat string
+
+const (
+	// ArchiveTar is a plain tar, read as git writes it. It's the default.
+	ArchiveTar ArchiveFormat = "tar"
+	// ArchiveTarGz is a gzipped tar, which is less to pipe from git for the
+	// cost of compressing and decompressing it.
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+	// ArchiveZip is a zip file. Zip files can't be read as they're written,
+	// so the whole archive is kept in memory while it's read.
+	ArchiveZip ArchiveFormat = "zip"
+)
+
+// WithArchiveFormat sets the format git archive writes the site in. Every
+// format yields the same files.
+func WithArchiveFormat(format ArchiveFormat) func(*Mirror) {
+	return func(m *Mirror) {
+		m.archiveFormat = format
+	}
+}
+
+// archiveReader returns a reader of the tar the archive in stdout, which is
+// in m's archive format, holds.
+func (m *Mirror) archiveReader(stdout io.Reader) (io.Reader, error) {
+	switch m.archiveFormat {
+	case ArchiveTarGz:
+		gz, err := gzip.NewReader(stdout)
+		if err != nil {
+			return nil, fmt.Errorf("read gzip header: %w", err)
+		}
+		return gz, nil
+	case ArchiveZip:
+		data, err := ioutil.ReadAll(stdout)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("read zip: %w", err)
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(zipToTar(zr, pw))
+		}()
+		return pr, nil
+	default:
+		return stdout, nil
+	}
+}
+
+// zipToTar writes the files in zr to w as a tar, so that zip archives can be
+// read like the others.
+func zipToTar(zr *zip.Reader, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		header := &tar.Header{
+			Name:    zf.Name,
+			Mode:    int64(mode.Perm()),
+			ModTime: zf.Modified,
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf(`open "%s" in zip: %w`, zf.Name, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf(`read "%s" in zip: %w`, zf.Name, err)
+		}
+		switch {
+		case mode.IsDir():
+			header.Typeflag = tar.TypeDir
+			data = nil
+		case mode&os.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = string(data)
+			data = nil
+		default:
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,117 @@
+package mirror2s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"gocloud.dev/blob"
+)
+
+// unsafeKeyChars matches runs of characters that don't belong in a key
+// segment made from a branch name.
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// branchKeySegment turns a branch name like "feature/Login" into a single key
+// segment like "feature-Login".
+func branchKeySegment(branch string) string {
+	return strings.Trim(unsafeKeyChars.ReplaceAllString(branch, "-"), "-.")
+}
+
+// resolveBranchPrefix appends the branch of the git ref to the key prefix,
+// if WithBranchPrefix is set and it hasn't been appended already.
+func (m *Mirror) resolveBranchPrefix() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.branchPrefix || m.branchResolved {
+		return nil
+	}
+	ref := m.gitRef
+	if i := strings.Index(ref, ":"); i >= 0 {
+		ref = ref[:i]
+	}
+	branch, err := m.gitOutput("rev-parse", "--abbrev-ref", ref)
+	if err != nil {
+		return fmt.Errorf(`find branch of git ref "%s": %w`, ref, err)
+	}
+	segment := branchKeySegment(branch)
+	if branch == "HEAD" || segment == "" {
+		return fmt.Errorf(`git ref "%s" isn't a branch`, ref)
+	}
+	m.previewBase = m.keyPrefix
+	m.keyPrefix += segment + "/"
+	m.branchResolved = true
+	return nil
+}
+
+// RemovePreview deletes the objects of the preview deploy of branch, made
+// with WithBranchPrefix, for when the branch is merged or abandoned. Objects
+// matching WithProtectedKeys are kept, and WithDryRun, WithNoDelete,
+// WithPlanFormat, and WithDeleteThreshold apply as they do to Run, the
+// threshold against every object under the key prefix.
+func (m *Mirror) RemovePreview(ctx context.Context, branch string) (*Result, error) {
+	ctx = m.runContext(ctx)
+	res := &Result{Ref: branch}
+	segment := branchKeySegment(branch)
+	if segment == "" {
+		return res, fmt.Errorf(`branch "%s" has no preview prefix`, branch)
+	}
+	m.mu.Lock()
+	base := m.keyPrefix
+	if m.branchResolved {
+		base = m.previewBase
+	}
+	m.mu.Unlock()
+	prefix := base + segment + "/"
+
+	bucket, err := m.openBucket(ctx)
+	if err != nil {
+		return res, classify(fmt.Errorf("open bucket: %w", err))
+	}
+	r := &mirrorRun{Mirror: m, bucket: bucket, res: res, started: m.clock.Now()}
+
+	// The whole base prefix is listed, for the delete threshold to compare
+	// the preview with.
+	var keys []string
+	total := 0
+	itr := bucket.List(&blob.ListOptions{
+		Prefix: base,
+		BeforeList: func(func(interface{}) bool) error {
+			r.countRequest(&res.Requests.Lists)
+			return nil
+		},
+	})
+	for {
+		obj, err := itr.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, classify(&UploadError{Op: "list", Key: base, Err: err})
+		}
+		total++
+		if !strings.HasPrefix(obj.Key, prefix) {
+			continue
+		}
+		if pattern := firstMatch(m.protectedKeys, obj.Key); pattern != "" {
+			m.logf(`keeping %s, it matches protected pattern "%s"…`, obj.Key, pattern)
+			continue
+		}
+		keys = append(keys, obj.Key)
+	}
+
+	if err := r.checkDeleteThreshold(len(keys), total); err != nil {
+		return res, err
+	}
+	if err := r.deleteObjects(ctx, keys); err != nil {
+		return res, classify(err)
+	}
+	if m.planFormat != "" {
+		if err := r.writePlan(m.planOutput); err != nil {
+			return res, fmt.Errorf("write plan: %w", err)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,45 @@
+package mirror2s3
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxListedKeys is how many keys an error lists before summarizing the rest.
+const maxListedKeys = 10
+
+// spendBudget counts uploading f against the limits set by WithMaxUploads and
+// WithMaxUploadBytes, returning an error instead if it would exceed them.
+func (r *mirrorRun) spendBudget(f *file, p *plan) error {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	var limit string
+	if r.maxUploads > 0 && r.uploads+1 > r.maxUploads {
+		limit = fmt.Sprintf("%d files", r.maxUploads)
+	} else if r.maxUploadBytes > 0 && r.uploadBytes+f.size > r.maxUploadBytes {
+		limit = fmt.Sprintf("%d bytes", r.maxUploadBytes)
+	}
+	if limit == "" {
+		r.uploads++
+		r.uploadBytes += f.size
+		return nil
+	}
+
+	// The file that didn't fit has been added to the site already.
+	notUploaded := []string{f.key}
+	for _, key := range p.keys {
+		if !r.site[key] {
+			notUploaded = append(notUploaded, key)
+		}
+	}
+	return fmt.Errorf("uploading %s would exceed the upload limit of %s after %d files (%d bytes); not uploaded: %s",
+		f.key, limit, r.uploads, r.uploadBytes, listKeys(notUploaded))
+}
+
+// listKeys joins keys for an error message, summarizing all but the first few.
+func listKeys(keys []string) string {
+	if len(keys) <= maxListedKeys {
+		return strings.Join(keys, ", ")
+	}
+	return fmt.Sprintf("%s, and %d more", strings.Join(keys[:maxListedKeys], ", "), len(keys)-maxListedKeys)
+}
@@ -0,0 +1,24 @@
+package mirror2s3
+
+import (
+	"regexp"
+	"strings"
+)
+
+// immutableCacheControl is the Cache-Control of fingerprinted files, whose
+// contents never change because a new version gets a new name.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// HashedAssetPattern matches fingerprinted file names like "app.3f9a2c.js"
+// and "logo-8d2e51f0.png". It's what WithImmutableHashedAssets uses when
+// given nil.
+var HashedAssetPattern = regexp.MustCompile(`[.-][0-9a-f]{6,}\.[^./]+$`)
+
+// cacheControlFor returns the Cache-Control for the object at key, or "" to
+// leave it unset.
+func (m *Mirror) cacheControlFor(key string) string {
+	if m.hashedAssets != nil && m.hashedAssets.MatchString(strings.TrimPrefix(key, m.keyPrefix)) {
+		return immutableCacheControl
+	}
+	return m.cacheControl
+}
@@ -0,0 +1,100 @@
+package mirror2s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"gocloud.dev/blob"
+)
+
+// ChecksumAlgorithm selects how Run recognizes files that are already in the
+// bucket.
+type ChecksumAlgorithm int
+
+const (
+	// ChecksumMD5 compares files against the MD5 the bucket lists for each
+	// object. It costs no extra requests. S3 doesn't report an MD5 for
+	// objects uploaded in multiple parts, so they're compared against their
+	// ETags, computed over the parts. Objects encrypted with SSE-KMS have no
+	// usable checksum at all, so they're always uploaded again.
+	ChecksumMD5 ChecksumAlgorithm = iota
+	// ChecksumSHA256 stores each file's SHA-256 in its object's metadata and
+	// compares files against that. It works regardless of how objects were
+	// uploaded or encrypted, but reading the metadata costs one request per
+	// file that's already in the bucket.
+	ChecksumSHA256
+)
+
+// sha256MetadataKey is the metadata key ChecksumSHA256 stores checksums under.
+const sha256MetadataKey = "sha256"
+
+// isUnchanged reports whether obj, the object at f's key (nil if there is
+// none), already has f's contents.
+func (r *mirrorRun) isUnchanged(ctx context.Context, obj *object, f *file) (bool, error) {
+	if obj == nil {
+		return false, nil
+	}
+	if obj.sha256 != "" {
+		return obj.sha256 == hex.EncodeToString(f.sha256), nil
+	}
+
+	switch r.checksum {
+	case ChecksumSHA256:
+		if obj.size != f.size {
+			return false, nil
+		}
+		attrs, err := r.attributes(ctx, obj)
+		if err != nil {
+			return false, err
+		}
+		return attrs.Metadata[sha256MetadataKey] == hex.EncodeToString(f.sha256), nil
+	default:
+		if obj.md5 != nil {
+			return bytes.Equal(f.md5[:], obj.md5), nil
+		}
+		if obj.etag != "" && obj.size == f.size {
+			if match, err := r.etagMatches(obj.etag, f); err != nil || match {
+				return match, err
+			}
+		}
+		if !r.sizeFallback || obj.size != f.size {
+			return false, nil
+		}
+		r.countRequest(&r.res.Requests.Gets)
+		return tailMatches(ctx, r.bucket, f)
+	}
+}
+
+// tailSize is how much of an object tailMatches compares.
+const tailSize = 4 << 10
+
+// tailMatches reports whether the end of f's object matches f's contents. It
+// catches most changes that don't affect a file's size, for the cost of a
+// small ranged read.
+func tailMatches(ctx context.Context, bucket *blob.Bucket, f *file) (bool, error) {
+	offset := f.size - tailSize
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := readRange(ctx, bucket, f.key, offset, f.size-offset)
+	if err != nil {
+		return false, fmt.Errorf("read tail: %w", err)
+	}
+	tail, err := f.readAt(offset, f.size-offset)
+	if err != nil {
+		return false, fmt.Errorf("read tail of local file: %w", err)
+	}
+	return bytes.Equal(data, tail), nil
+}
+
+func readRange(ctx context.Context, bucket *blob.Bucket, key string, offset, length int64) ([]byte, error) {
+	r, err := bucket.NewRangeReader(ctx, key, offset, length, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
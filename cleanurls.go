@@ -0,0 +1,79 @@
+package mirror2s3
+
+import (
+	"path"
+	"strings"
+)
+
+// CleanURLMode controls whether Run uploads the site's HTML files at keys
+// without ".html", so that "about.html" can be served at "/about".
+type CleanURLMode int
+
+const (
+	// CleanURLsNone uploads HTML files at their own names only. This is the
+	// default.
+	CleanURLsNone CleanURLMode = iota
+	// CleanURLsCopy uploads each HTML file at its own name, "about.html", and
+	// a copy at its clean URL, "about".
+	CleanURLsCopy
+	// CleanURLsOnly uploads each HTML file at its clean URL alone. Index files
+	// are still uploaded at their own names too, for index documents.
+	CleanURLsOnly
+)
+
+// WithCleanURLs makes Run upload the site's HTML files at keys without
+// ".html", for sites served from the bucket's REST endpoint, as by
+// CloudFront, which has no way to map "/about" to "about.html". The clean URL
+// of a directory's index.html is the directory's, so "blog/index.html" is
+// also uploaded at "blog", though the root index.html has no clean URL of its
+// own. Objects at clean URLs get the content type and ACL of their files'
+// names, like text/html, despite having no extension.
+func WithCleanURLs(mode CleanURLMode) func(*Mirror) {
+	return func(m *Mirror) {
+		m.cleanURLs = mode
+	}
+}
+
+// isHTML reports whether name is an HTML file whose clean URL drops its
+// extension.
+func isHTML(name string) bool {
+	return strings.ToLower(path.Ext(name)) == ".html" && path.Base(name) != "index.html"
+}
+
+// siteKey returns the key the file at name is uploaded at.
+func (m *Mirror) siteKey(name string) string {
+	if m.cleanURLs == CleanURLsOnly && isHTML(name) {
+		name = name[:len(name)-len(path.Ext(name))]
+	}
+	return m.keyPrefix + name
+}
+
+// cleanURLKey returns the key of the copy of the file at key Run uploads at
+// its clean URL, or "" if there isn't one.
+func (m *Mirror) cleanURLKey(key string) string {
+	if m.cleanURLs == CleanURLsNone || !strings.HasPrefix(key, m.keyPrefix) {
+		return ""
+	}
+	name := key[len(m.keyPrefix):]
+	switch {
+	case path.Base(name) == "index.html":
+		if dir := path.Dir(name); dir != "." {
+			return m.keyPrefix + dir
+		}
+		// The root of the site has no key of its own under the prefix.
+		return ""
+	case isHTML(name):
+		return m.keyPrefix + name[:len(name)-len(path.Ext(name))]
+	}
+	return ""
+}
+
+// cleanURLFile returns the copy of f generated for its clean URL, or nil if
+// there isn't one.
+func (m *Mirror) cleanURLFile(f *file) *file {
+	key := m.cleanURLKey(f.key)
+	if key == "" {
+		return nil
+	}
+	return m.copyFile(f, key)
+}
@@ -0,0 +1,81 @@
+package mirror2s3
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// clock tells Run the time. Run uses it rather than the time package, so
+// that timing-sensitive code like locking can be run against a fake clock.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	// Tick returns a channel that receives the time every d, and a function
+	// that stops it.
+	Tick(d time.Duration) (<-chan time.Time, func())
+}
+
+// withClock makes Run tell the time with c instead of the real clock, for
+// tests.
+func withClock(c clock) func(*Mirror) {
+	return func(m *Mirror) {
+		m.clock = c
+	}
+}
+
+// realClock is the clock Run normally uses.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// sleep waits for d on c, returning early with ctx's error if it's done first.
+func sleep(ctx context.Context, c clock, d time.Duration) error {
+	select {
+	case <-c.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lockedRand is a source of random numbers that concurrent uploads can share.
+// Run uses it rather than math/rand's global source, for the same reason as
+// it uses clock: so that it can be seeded to make retries' jitter
+// repeatable.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// newLockedRand returns a lockedRand seeded with seed.
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+// withRandSeed seeds the jitter of retries' delays, for tests that need it to
+// be the same every time.
+func withRandSeed(seed int64) func(*Mirror) {
+	return func(m *Mirror) {
+		m.rand = newLockedRand(seed)
+	}
+}
+
+// Int63n returns a random number in [0, n).
+func (l *lockedRand) Int63n(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int63n(n)
+}
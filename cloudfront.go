@@ -0,0 +1,106 @@
+package mirror2s3
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+)
+
+const (
+	// invalidationBatchSize is the most paths Run puts in one invalidation.
+	invalidationBatchSize = 1000
+	// maxInvalidationPaths is the most paths Run invalidates one by one.
+	// CloudFront allows 3,000 paths in progress per distribution, so beyond
+	// that Run invalidates everything under the key prefix instead.
+	maxInvalidationPaths = 3000
+)
+
+// WithCloudFrontDistribution makes Run invalidate the paths of the objects
+// it uploaded or deleted in the CloudFront distribution with the given ID,
+// once everything else has succeeded, so the distribution stops serving the
+// old files. The invalidations' IDs are in Result.Invalidations.
+//
+// Each object's path is "/" followed by its key, which assumes the
+// distribution serves the root of the bucket. An index.html also has the
+// path of its directory invalidated. If more files changed than CloudFront
+// lets be invalidated at once, everything under the key prefix is
+// invalidated instead.
+func WithCloudFrontDistribution(id string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.distributionID = id
+	}
+}
+
+// invalidationPaths returns the sorted paths to invalidate for keys.
+func invalidationPaths(keys []string) []string {
+	seen := map[string]bool{}
+	var paths []string
+	add := func(key string) {
+		p := (&url.URL{Path: "/" + key}).EscapedPath()
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, key := range keys {
+		add(key)
+		if key == "index.html" || strings.HasSuffix(key, "/index.html") {
+			add(strings.TrimSuffix(key, "index.html"))
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// invalidate invalidates the paths of the objects uploaded or deleted in the
+// CloudFront distribution.
+func (r *mirrorRun) invalidate(ctx context.Context) error {
+	r.resMu.Lock()
+	keys := append(append([]string(nil), r.res.Uploaded...), r.res.Deleted...)
+	r.resMu.Unlock()
+	paths := invalidationPaths(keys)
+	if len(paths) == 0 {
+		return nil
+	}
+	if len(paths) > maxInvalidationPaths {
+		r.logf("%d paths changed, more than CloudFront can invalidate one by one; invalidating everything under the prefix…", len(paths))
+		paths = []string{(&url.URL{Path: "/" + r.keyPrefix}).EscapedPath() + "*"}
+	}
+	if r.dryRun {
+		r.logf("would invalidate %d paths in CloudFront distribution %s…", len(paths), r.distributionID)
+		return nil
+	}
+
+	sess, err := r.awsSession()
+	if err != nil {
+		return err
+	}
+	svc := cloudfront.New(sess)
+	for i := 0; i < len(paths); i += invalidationBatchSize {
+		batch := paths[i:minInt(i+invalidationBatchSize, len(paths))]
+		r.logf("invalidating %d paths in CloudFront distribution %s…", len(batch), r.distributionID)
+		out, err := svc.CreateInvalidationWithContext(ctx, &cloudfront.CreateInvalidationInput{
+			DistributionId: aws.String(r.distributionID),
+			InvalidationBatch: &cloudfront.InvalidationBatch{
+				// The reference only has to be unique to the distribution.
+				CallerReference: aws.String(fmt.Sprintf("mirror2s3-%d-%d", r.started.UnixNano(), i/invalidationBatchSize)),
+				Paths: &cloudfront.Paths{
+					Items:    aws.StringSlice(batch),
+					Quantity: aws.Int64(int64(len(batch))),
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		r.resMu.Lock()
+		r.res.Invalidations = append(r.res.Invalidations, aws.StringValue(out.Invalidation.Id))
+		r.resMu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// Command mirror2s3 mirrors a git repository's files to an S3 bucket.
+//
+// Usage:
+//
+//	mirror2s3 [flags]
+//
+// Options can also be set in a .mirror2s3.yaml at the root of the repository,
+// so that deploying is just "mirror2s3":
+//
+//	bucket: s3://example.com
+//	region: us-west-2
+//	prefix: site/
+//	prune: true
+//
+// Flags override the file. Each flag has a key of the same name, except that
+// -dry-run is "dryRun". The file itself is never uploaded.
+//
+// With -watch, mirror2s3 keeps running, mirroring the ref again whenever it
+// changes. -listen also serves a push webhook, which makes it check right
+// away, at POST /.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/alltom/mirror2s3"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is the name of the config file read from the root of the
+// repository.
+const configFile = ".mirror2s3.yaml"
+
+// config is the options, from the config file and flags.
+type config struct {
+	Repo        string `yaml:"repo"`
+	Ref         string `yaml:"ref"`
+	Bucket      string `yaml:"bucket"`
+	Prefix      string `yaml:"prefix"`
+	Profile     string `yaml:"profile"`
+	Region      string `yaml:"region"`
+	DryRun      bool   `yaml:"dryRun"`
+	Concurrency int    `yaml:"concurrency"`
+	Prune       bool   `yaml:"prune"`
+
+	Watch    time.Duration `yaml:"watch"`
+	Debounce time.Duration `yaml:"debounce"`
+	Fetch    string        `yaml:"fetch"`
+	Listen   string        `yaml:"listen"`
+}
+
+func main() {
+	log.SetFlags(0)
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatalf("mirror2s3: %v", err)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("mirror2s3", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file (default: "+configFile+" in the repository, if there is one)")
+	var flags config
+	fs.StringVar(&flags.Repo, "repo", ".", "root of the git repository to mirror")
+	fs.StringVar(&flags.Ref, "ref", "HEAD", "git ref to mirror")
+	fs.StringVar(&flags.Bucket, "bucket", "", "URL of the bucket, like s3://example.com")
+	fs.StringVar(&flags.Prefix, "prefix", "", "prefix of the keys of the mirrored files")
+	fs.StringVar(&flags.Profile, "profile", "", "AWS profile")
+	fs.StringVar(&flags.Region, "region", "", "AWS region")
+	fs.BoolVar(&flags.DryRun, "dry-run", false, "log what would change without changing anything")
+	fs.IntVar(&flags.Concurrency, "concurrency", 0, "number of files to upload at once (default 1)")
+	fs.BoolVar(&flags.Prune, "prune", false, "delete objects that aren't in the repository")
+	fs.DurationVar(&flags.Watch, "watch", 0, "keep running, checking the ref for changes this often")
+	fs.DurationVar(&flags.Debounce, "debounce", 0, "with -watch, wait until the ref hasn't changed for this long")
+	fs.StringVar(&flags.Fetch, "fetch", "", "with -watch, git remote to fetch before each check")
+	fs.StringVar(&flags.Listen, "listen", "", "with -watch, address to serve a webhook that triggers a check, like :8080")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	conf := flags
+	path, required := *configPath, true
+	if path == "" {
+		path, required = filepath.Join(flags.Repo, configFile), false
+	}
+	if err := readConfig(path, required, &conf); err != nil {
+		return err
+	}
+	// Flags override the file.
+	if set["repo"] || conf.Repo == "" {
+		conf.Repo = flags.Repo
+	}
+	if set["ref"] || conf.Ref == "" {
+		conf.Ref = flags.Ref
+	}
+	if set["bucket"] {
+		conf.Bucket = flags.Bucket
+	}
+	if set["prefix"] {
+		conf.Prefix = flags.Prefix
+	}
+	if set["profile"] {
+		conf.Profile = flags.Profile
+	}
+	if set["region"] {
+		conf.Region = flags.Region
+	}
+	if set["dry-run"] {
+		conf.DryRun = flags.DryRun
+	}
+	if set["concurrency"] {
+		conf.Concurrency = flags.Concurrency
+	}
+	if set["prune"] {
+		conf.Prune = flags.Prune
+	}
+	if set["watch"] {
+		conf.Watch = flags.Watch
+	}
+	if set["debounce"] {
+		conf.Debounce = flags.Debounce
+	}
+	if set["fetch"] {
+		conf.Fetch = flags.Fetch
+	}
+	if set["listen"] {
+		conf.Listen = flags.Listen
+	}
+	if conf.Bucket == "" {
+		return errors.New("no bucket; set -bucket or bucket in " + configFile)
+	}
+	if conf.Watch == 0 && (conf.Debounce != 0 || conf.Fetch != "" || conf.Listen != "") {
+		return errors.New("-debounce, -fetch, and -listen need -watch")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	m := mirror2s3.New(
+		mirror2s3.WithGitRepoRoot(conf.Repo),
+		mirror2s3.WithGitRef(conf.Ref),
+		mirror2s3.WithBucketURL(conf.Bucket),
+		mirror2s3.WithKeyPrefix(conf.Prefix),
+		mirror2s3.WithAwsProfile(conf.Profile),
+		mirror2s3.WithAwsRegion(conf.Region),
+		mirror2s3.WithDryRun(conf.DryRun),
+		mirror2s3.WithConcurrency(conf.Concurrency),
+		mirror2s3.WithPrune(conf.Prune),
+		// The config names the bucket and AWS profile, which aren't for the
+		// public.
+		mirror2s3.WithExclude("/"+configFile),
+		mirror2s3.WithWatchDebounce(conf.Debounce),
+		mirror2s3.WithWatchFetch(conf.Fetch),
+		mirror2s3.WithAfterRun(logResult),
+	)
+	defer m.Close()
+	if conf.Watch == 0 {
+		_, err := m.Run(ctx)
+		return err
+	}
+
+	if conf.Listen != "" {
+		server := &http.Server{Addr: conf.Listen, Handler: m.WatchHandler()}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("mirror2s3: webhook: %v", err)
+				cancel()
+			}
+		}()
+		defer server.Close()
+	}
+	if err := m.Watch(ctx, conf.Watch); err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+// logResult logs a summary of what a Run did.
+func logResult(ctx context.Context, res *mirror2s3.Result, err error) error {
+	log.Printf("uploaded %d files (%d bytes), skipped %d, deleted %d in %v", len(res.Uploaded), res.UploadedBytes, len(res.Skipped), len(res.Deleted), res.Duration.Round(time.Millisecond))
+	return err
+}
+
+// readConfig reads the config file at path into conf. It's not an error for
+// the file not to exist unless it's required.
+func readConfig(path string, required bool, conf *config) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, conf); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package mirror2s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Compression is a content encoding Run can compress files with; see
+// WithCompression.
+type Compression string
+
+const (
+	// CompressionGzip compresses files with gzip, which every browser
+	// accepts.
+	CompressionGzip Compression = "gzip"
+	// CompressionBrotli compresses files with Brotli, which is smaller than
+	// gzip, but which browsers only accept over HTTPS.
+	CompressionBrotli Compression = "br"
+)
+
+// WithCompression makes Run compress the files whose content types are worth
+// compressing, such as HTML, CSS, and JavaScript, and which are at least
+// minSize bytes, and upload them compressed, with their Content-Encoding set.
+// S3 doesn't compress objects itself, and serves them to every client as
+// they are, so only use encodings the site's visitors accept.
+//
+// Compression always makes the same bytes of the same file, so unchanged
+// files are still skipped. Files that don't get smaller, and files a
+// transform has already encoded, are uploaded as they are. It can't be
+// combined with WithGzipSiblings, whose copies would be compressed twice.
+func WithCompression(compression Compression, minSize int) func(*Mirror) {
+	return func(m *Mirror) {
+		m.compression = compression
+		m.compressMinSize = minSize
+	}
+}
+
+// compress returns data, the contents of the file at name, of the given
+// content type, compressed, and its content encoding, or data and "" if it
+// isn't to be compressed.
+func (m *Mirror) compress(name, contentType string, data []byte) ([]byte, string, error) {
+	if m.compression == "" || len(data) < m.compressMinSize || !m.isCompressibleFile(name, contentType) {
+		return data, "", nil
+	}
+	var compressed []byte
+	var err error
+	switch m.compression {
+	case CompressionBrotli:
+		compressed, err = brotliBytes(data)
+	default:
+		compressed, err = gzipBytes(data)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if len(compressed) >= len(data) {
+		return data, "", nil
+	}
+	return compressed, string(m.compression), nil
+}
+
+// compressibleTypes are the media types outside of text/* that are worth
+// compressing.
+var compressibleTypes = map[string]bool{
+	"application/javascript":    true,
+	"application/json":          true,
+	"application/manifest+json": true,
+	"application/rss+xml":       true,
+	"application/atom+xml":      true,
+	"application/wasm":          true,
+	"application/xml":           true,
+	"image/svg+xml":             true,
+}
+
+// isCompressible reports whether files of the given content type are worth
+// compressing. Most other types, like images and video, are compressed
+// already.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// isCompressibleFile reports whether the file at name, of the given content
+// type, is worth compressing. Without a content type, as with
+// WithNoContentType, its name's is used.
+func (m *Mirror) isCompressibleFile(name, contentType string) bool {
+	if contentType == "" {
+		contentType = m.contentTypeFor(name)
+	}
+	return isCompressible(contentType)
+}
+
+// gzipSiblingKey returns the key of the gzipped copy of the file at key, of
+// the given content type, or "" if there isn't one.
+func (m *Mirror) gzipSiblingKey(key, contentType string) string {
+	if !m.gzipSiblings || path.Ext(key) == ".gz" || !m.isCompressibleFile(key, contentType) {
+		return ""
+	}
+	if firstMatch(m.gzipExclude, key) != "" {
+		return ""
+	}
+	return key + ".gz"
+}
+
+// gzipSibling returns the gzipped copy of f, or nil if there isn't one. Its
+// checksums are of the gzipped bytes, which are the same every time f is
+// compressed, so an unchanged copy is skipped like any other file.
+func (m *Mirror) gzipSibling(f *file) (*file, error) {
+	key := m.gzipSiblingKey(f.key, f.contentType)
+	if key == "" || f.contentEncoding != "" || f.spooled != nil {
+		return nil, nil
+	}
+	data, err := gzipBytes(f.data)
+	if err != nil {
+		return nil, err
+	}
+	gz := m.newFile(key, data, f.contentType)
+	gz.contentEncoding = "gzip"
+	return gz, nil
+}
+
+// varyMetadataKey is the metadata key WithVaryAcceptEncoding sets.
+const varyMetadataKey = "vary"
+
+// varies reports whether f is a file with a gzipped copy, or the copy, and so
+// varies by Accept-Encoding.
+func (m *Mirror) varies(f *file) bool {
+	if !m.varyAcceptEncoding {
+		return false
+	}
+	return f.contentEncoding == "gzip" || m.gzipSiblingKey(f.key, f.contentType) != ""
+}
+
+// gzipBytes compresses data. The gzip header is left without a name or
+// modification time, so the same data always compresses to the same bytes
+// and unchanged files can be skipped.
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// brotliBytes compresses data with Brotli, which, like gzipBytes, always
+// compresses the same data to the same bytes.
+func brotliBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
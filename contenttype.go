@@ -0,0 +1,163 @@
+package mirror2s3
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// defaultContentTypes are the content types of common web files, which take
+// precedence over the system's MIME database because it varies between
+// systems (.xml is text/xml on some).
+var defaultContentTypes = map[string]string{
+	".avif":        "image/avif",
+	".json":        "application/json",
+	".txt":         "text/plain; charset=utf-8",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff2":       "font/woff2",
+	".xml":         "application/xml",
+}
+
+// contentTypeFor returns the content type of the file at name, from the
+// first of these to have one for its extension: WithContentTypes, the file
+// given to WithMimeTypesFile, Run's defaults, and the system's MIME database.
+// It returns "" if none does.
+func (m *Mirror) contentTypeFor(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if contentType, ok := m.contentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType, ok := m.fileContentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType, ok := defaultContentTypes[ext]; ok {
+		return contentType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// sniffContentType returns the content type of a file with no known
+// extension, detected from head, the start of its contents.
+func sniffContentType(head []byte) string {
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	return http.DetectContentType(head)
+}
+
+// isRetyped reports whether obj, which already has f's contents, needs to be
+// uploaded again because its content type isn't the one f would be given.
+func (r *mirrorRun) isRetyped(ctx context.Context, obj *object, f *file) (bool, error) {
+	if f.contentType == "" {
+		return false, nil
+	}
+	attrs, err := r.attributes(ctx, obj)
+	if err != nil {
+		return false, err
+	}
+	return attrs.ContentType != f.contentType, nil
+}
+
+// hasContentTypeOption reports whether WithContentTypes sets the content type
+// of the file at name.
+func (m *Mirror) hasContentTypeOption(name string) bool {
+	_, ok := m.contentTypes[strings.ToLower(path.Ext(name))]
+	return ok
+}
+
+// loadMimeTypes reads the file given to WithMimeTypesFile, if it hasn't been
+// read already.
+func (m *Mirror) loadMimeTypes() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mimeTypesFile == "" || m.fileContentTypes != nil {
+		return nil
+	}
+	types, err := readMimeTypes(m.mimeTypesFile)
+	if err != nil {
+		return fmt.Errorf("read mime types: %w", err)
+	}
+	m.fileContentTypes = types
+	return nil
+}
+
+// readMimeTypes reads an Apache-style mime.types file, in which each line is
+// a content type followed by its extensions, into a map from extension to
+// content type.
+func readMimeTypes(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	types := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			types["."+strings.ToLower(ext)] = fields[0]
+		}
+	}
+	return types, scanner.Err()
+}
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+// ContentTypes returns the content type Run would upload each file in the
+// site with, by key, without contacting the bucket. Files whose extensions
+// have no content type are given the one detected from their contents,
+// unless WithNoContentType is set, in which case they're given "".
+func (m *Mirror) ContentTypes(ctx context.Context) (map[string]string, error) {
+	ctx = m.runContext(ctx)
+	r, err := m.newLocalRun(&Result{Ref: m.gitRef})
+	if err != nil {
+		return nil, err
+	}
+	plan, err := r.plan(r.treeish, r.only)
+	if err != nil {
+		return nil, fmt.Errorf("plan: %w", err)
+	}
+	defer plan.spool.remove()
+	tarf, err := r.getSiteTar(r.treeish)
+	if err != nil {
+		return nil, fmt.Errorf("get site tar: %w", err)
+	}
+	defer tarf.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	files := make(chan *file, fileQueueSize)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(files)
+		readErr <- r.readFiles(ctx, tarf.Reader, plan, files)
+	}()
+
+	types := map[string]string{}
+	for f := range files {
+		types[f.key] = f.contentType
+	}
+	if err := <-readErr; err != nil {
+		return nil, err
+	}
+	if err := tarf.Close(); err != nil {
+		return nil, fmt.Errorf("get site tar: %w", err)
+	}
+	return types, nil
+}
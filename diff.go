@@ -0,0 +1,128 @@
+package mirror2s3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// DiffResult describes how the bucket differs from the site. Each list of
+// keys is sorted.
+type DiffResult struct {
+	// Ref and CommitSHA are as in Result.
+	Ref       string
+	CommitSHA string
+
+	// OnlyLocal is the keys of files that aren't in the bucket.
+	OnlyLocal []string
+	// OnlyRemote is the keys of objects that aren't part of the site, which
+	// Run would prune.
+	OnlyRemote []string
+	// Mismatched is the keys of objects whose contents differ from the site.
+	Mismatched []string
+}
+
+// UpToDate reports whether the bucket matches the site.
+func (d *DiffResult) UpToDate() bool {
+	return len(d.OnlyLocal) == 0 && len(d.OnlyRemote) == 0 && len(d.Mismatched) == 0
+}
+
+// Diff compares the site with the bucket without changing either. Objects
+// are compared by size first, so a file's contents are only read when its
+// object is the same size and the bucket has a checksum to compare against.
+func (m *Mirror) Diff(ctx context.Context) (*DiffResult, error) {
+	ctx = m.runContext(ctx)
+	res := &Result{Ref: m.gitRef}
+	r, err := m.newRun(ctx, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.listRemote(ctx); err != nil {
+		return nil, err
+	}
+	plan, err := r.plan(r.treeish, r.onlyFiles)
+	if err != nil {
+		return nil, fmt.Errorf("plan: %w", err)
+	}
+	defer plan.spool.remove()
+	r.gitignore = plan.gitignore
+
+	d := &DiffResult{Ref: res.Ref, CommitSHA: res.CommitSHA}
+	r.site = map[string]bool{}
+	toHash := map[string]bool{}
+	for _, key := range plan.keys {
+		r.site[key] = true
+		obj := r.remote[key]
+		switch {
+		case obj == nil:
+			d.OnlyLocal = append(d.OnlyLocal, key)
+		case plan.sizes[key] < 0:
+			// The size isn't known without reading the file.
+			toHash[key] = true
+		case obj.size != plan.sizes[key]:
+			d.Mismatched = append(d.Mismatched, key)
+		case r.checksum == ChecksumMD5 && obj.md5 == nil:
+			// The size is all there is to go on.
+		default:
+			toHash[key] = true
+		}
+	}
+	for key, obj := range r.remote {
+		if r.isStale(obj) {
+			d.OnlyRemote = append(d.OnlyRemote, key)
+		}
+	}
+
+	if len(toHash) > 0 {
+		mismatched, err := r.mismatched(ctx, plan, toHash)
+		if err != nil {
+			return nil, err
+		}
+		d.Mismatched = append(d.Mismatched, mismatched...)
+	}
+
+	sort.Strings(d.OnlyLocal)
+	sort.Strings(d.OnlyRemote)
+	sort.Strings(d.Mismatched)
+	return d, nil
+}
+
+// mismatched reads the files with the given keys and returns the keys of
+// those that differ from their objects.
+func (r *mirrorRun) mismatched(ctx context.Context, plan *plan, keys map[string]bool) ([]string, error) {
+	tarf, err := r.getSiteTar(r.treeish)
+	if err != nil {
+		return nil, fmt.Errorf("get site tar: %w", err)
+	}
+	defer tarf.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	files := make(chan *file, fileQueueSize)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(files)
+		readErr <- r.readFiles(ctx, tarf.Reader, plan, files)
+	}()
+
+	var mismatched []string
+	for f := range files {
+		if !keys[f.key] {
+			continue
+		}
+		unchanged, err := r.isUnchanged(ctx, r.remote[f.key], f)
+		if err != nil {
+			return nil, fmt.Errorf(`compare file "%s": %w`, f.key, err)
+		}
+		if !unchanged {
+			mismatched = append(mismatched, f.key)
+		}
+	}
+	if err := <-readErr; err != nil {
+		return nil, err
+	}
+	if err := tarf.Close(); err != nil {
+		return nil, fmt.Errorf("get site tar: %w", err)
+	}
+	return mismatched, nil
+}
@@ -0,0 +1,90 @@
+package mirror2s3
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// applyDiffRange limits the Run to the files that changed between the commit
+// set with WithDiffRange and the one being mirrored.
+func (r *mirrorRun) applyDiffRange() error {
+	_, from, err := r.resolveRef(r.diffFrom)
+	if err != nil {
+		return err
+	}
+	if from == "" {
+		return fmt.Errorf(`git ref "%s" isn't a commit`, r.diffFrom)
+	}
+	if r.res.CommitSHA == "" {
+		return fmt.Errorf(`git ref "%s" isn't a commit`, r.gitRef)
+	}
+
+	// Without rename detection, renames are listed as a delete and an add.
+	args := []string{"diff", "--name-status", "--no-renames", "-z"}
+	if dir := refDir(r.gitRef); dir != "" {
+		// Only the directory is archived, so list its changes relative to it.
+		args = append(args, "--relative="+dir+"/")
+	}
+	out, err := r.gitOutput(append(args, from, r.res.CommitSHA)...)
+	if err != nil {
+		return fmt.Errorf("git diff: %w", err)
+	}
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	r.only = map[string]bool{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, name := fields[i], fields[i+1]
+		if !r.keepPaths {
+			name = normalizePath(name)
+		}
+		switch status {
+		case "D":
+			r.removed = append(r.removed, name)
+		default:
+			r.only[name] = true
+		}
+	}
+	return nil
+}
+
+// refDir returns the directory a ref like "HEAD:website" names within its
+// commit, or "" if it names the whole commit.
+func refDir(ref string) string {
+	i := strings.Index(ref, ":")
+	if i < 0 {
+		return ""
+	}
+	return strings.Trim(path.Clean("/"+ref[i+1:]), "/")
+}
+
+// deleteRemoved deletes the objects of the files the diff range removed, and
+// the objects Run generated from them, unless they're still part of the site
+// or Run mustn't touch them.
+func (r *mirrorRun) deleteRemoved(ctx context.Context) error {
+	var keys []string
+	for _, name := range r.removed {
+		key := r.siteKey(name)
+		candidates := []string{key}
+		// The file is gone, so its content type is guessed from its name.
+		contentType := r.finalContentType(nil, name, r.contentTypeFor(name), nil)
+		for derivedKey := range r.derivedKeys(key, contentType, 0) {
+			candidates = append(candidates, derivedKey)
+		}
+		for _, key := range candidates {
+			if r.site[key] || r.excludedKey(key) != "" || r.keepIgnored(key) {
+				continue
+			}
+			obj, err := r.lookup(ctx, key)
+			if err != nil {
+				return fmt.Errorf(`look up "%s": %w`, key, err)
+			}
+			if obj != nil {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return r.deleteObjects(ctx, keys)
+}
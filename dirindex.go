@@ -0,0 +1,83 @@
+package mirror2s3
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// DirectoryIndexMode controls what Run uploads at the key of a directory
+// ("blog/") that contains an index.html.
+type DirectoryIndexMode int
+
+const (
+	// DirectoryIndexNone uploads nothing for directories. This is the default.
+	DirectoryIndexNone DirectoryIndexMode = iota
+	// DirectoryIndexCopy uploads a copy of the directory's index.html.
+	DirectoryIndexCopy
+	// DirectoryIndexRedirect uploads an empty object that redirects to the
+	// directory's index.html. Only S3 supports redirects, and only its website
+	// endpoints follow them.
+	DirectoryIndexRedirect
+)
+
+// directoryIndexKey returns the key of the directory object generated for the
+// file at key, or "" if there isn't one.
+func (m *Mirror) directoryIndexKey(key string) string {
+	if m.directoryIndex == DirectoryIndexNone || !strings.HasPrefix(key, m.keyPrefix) {
+		return ""
+	}
+	name := key[len(m.keyPrefix):]
+	if path.Base(name) != "index.html" {
+		return ""
+	}
+	dir := path.Dir(name)
+	if dir == "." {
+		// The root of the site has no key of its own under the prefix.
+		return ""
+	}
+	return m.keyPrefix + dir + "/"
+}
+
+// directoryIndexFile returns the directory object generated for f, or nil if
+// there isn't one.
+func (m *Mirror) directoryIndexFile(f *file) *file {
+	key := m.directoryIndexKey(f.key)
+	if key == "" {
+		return nil
+	}
+	if m.directoryIndex == DirectoryIndexRedirect {
+		index := m.newFile(key, nil, "")
+		index.redirect = "/" + f.key
+		return index
+	}
+	return m.copyFile(f, key)
+}
+
+// copyFile returns a copy of f to upload at key.
+func (m *Mirror) copyFile(f *file, key string) *file {
+	var c *file
+	if f.spooled != nil {
+		c = m.newSpooledFile(key, f.spooled, f.contentType)
+	} else {
+		c = m.newFile(key, f.data, f.contentType)
+	}
+	c.contentEncoding = f.contentEncoding
+	return c
+}
+
+// websiteRedirect returns a BeforeWrite function that makes the written
+// object redirect to location.
+func websiteRedirect(location string) func(func(interface{}) bool) error {
+	return func(as func(interface{}) bool) error {
+		var in *s3manager.UploadInput
+		if !as(&in) {
+			return errors.New("redirects are only supported by S3")
+		}
+		in.WebsiteRedirectLocation = aws.String(location)
+		return nil
+	}
+}
@@ -0,0 +1,10 @@
+package mirror2s3
+
+// Buckets are opened by URL with the gocloud.dev/blob drivers registered
+// here. S3 is built in, and so are file:// and mem:// buckets, for local
+// previews and tests. Build with the gcs or azure tags to add gs:// and
+// azblob:// buckets, which bring in those clouds' SDKs.
+import (
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/memblob"
+)
@@ -0,0 +1,8 @@
+//go:build azure
+// +build azure
+
+package mirror2s3
+
+// azblob:// buckets read the storage account from AZURE_STORAGE_ACCOUNT, and
+// its key or a SAS token from AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN.
+import _ "gocloud.dev/blob/azureblob"
@@ -0,0 +1,7 @@
+//go:build gcs
+// +build gcs
+
+package mirror2s3
+
+// gs:// buckets use Google Application Default Credentials.
+import _ "gocloud.dev/blob/gcsblob"
@@ -0,0 +1,104 @@
+package mirror2s3
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"gocloud.dev/gcerrors"
+)
+
+// Run's errors can be tested for these with errors.Is, for example to choose
+// a command's exit status.
+var (
+	// ErrNotGitRepo is returned by Run when the repo root or git dir isn't a
+	// git repository, or doesn't exist.
+	ErrNotGitRepo = errors.New("not a git repository")
+	// ErrEmptyArchive is returned by Run when WithFailOnEmpty is set and the
+	// site has no files to upload, which usually means the wrong ref or a
+	// broken build.
+	ErrEmptyArchive = errors.New("the site has no files to upload")
+	// ErrAccessDenied is returned by Run when the bucket refused a request
+	// for lack of permission.
+	ErrAccessDenied = errors.New("access denied")
+	// ErrLocked is returned by Run when WithLock is set and another Run holds
+	// the lock on the bucket.
+	ErrLocked = errors.New("another run holds the lock")
+	// ErrDeleteThresholdExceeded is returned by Run when pruning would delete
+	// more of the bucket than WithDeleteThreshold allows, and by
+	// RemovePreview when removing the preview would.
+	ErrDeleteThresholdExceeded = errors.New("too many objects to delete")
+	// ErrNotEmpty is returned by Run when WithRequireEmpty is set and the
+	// bucket already has objects under the key prefix.
+	ErrNotEmpty = errors.New("the bucket isn't empty")
+)
+
+// UploadError is the error for a failed request about a single object in the
+// bucket, such as an upload or a delete. Result.Errors holds UploadErrors for
+// the failures Run kept going after.
+type UploadError struct {
+	// Op is what was being done: "upload", "copy", "delete", "get
+	// attributes", or "list".
+	Op string
+	// Key is the key of the object, or for "list", the prefix being listed.
+	Key string
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	if e.Op == "list" && e.Key == "" {
+		return fmt.Sprintf("list bucket: %v", e.Err)
+	}
+	return fmt.Sprintf(`%s "%s": %v`, e.Op, e.Key, e.Err)
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// errDeletesDisabled is the cause of the UploadError for a delete refused
+// because of WithNoDelete.
+var errDeletesDisabled = errors.New("deletes are disabled")
+
+// accessDeniedError is a bucket error that's also ErrAccessDenied.
+type accessDeniedError struct {
+	err error
+}
+
+func (e *accessDeniedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *accessDeniedError) Unwrap() error {
+	return e.err
+}
+
+func (e *accessDeniedError) Is(target error) bool {
+	return target == ErrAccessDenied
+}
+
+// classify makes err match the sentinel error for its cause, where the cause
+// can't be known until then.
+func classify(err error) error {
+	if isAccessDenied(err) && !errors.Is(err, ErrAccessDenied) {
+		return &accessDeniedError{err}
+	}
+	return err
+}
+
+// isAccessDenied reports whether err is a bucket's refusal of a request for
+// lack of permission. The S3 driver doesn't report these as PermissionDenied,
+// so S3's own error codes are checked too.
+func isAccessDenied(err error) bool {
+	if gcerrors.Code(err) == gcerrors.PermissionDenied {
+		return true
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case "AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package mirror2s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// multipartETagOf returns the ETag of an object uploaded to S3 in parts,
+// given the As function of its listing or attributes, or "" if it wasn't
+// uploaded in parts. Such ETags are "<hex>-<parts>", and the bucket lists no
+// MD5 for them.
+func multipartETagOf(as func(interface{}) bool) string {
+	var etag *string
+	var obj s3.Object
+	var head s3.HeadObjectOutput
+	if as(&obj) {
+		etag = obj.ETag
+	} else if as(&head) {
+		etag = head.ETag
+	}
+	if etag == nil || !strings.Contains(*etag, "-") {
+		return ""
+	}
+	return strings.Trim(*etag, `"`)
+}
+
+// uploadPartSize returns the size of the parts a file of the given size is
+// uploaded in, if it's large enough to be uploaded in parts at all.
+func (m *Mirror) uploadPartSize(size int64) int64 {
+	if part := m.bufferSize(size); part != 0 {
+		return int64(part)
+	}
+	return s3manager.DefaultUploadPartSize
+}
+
+// multipartETag returns the ETag S3 gives f's contents when they're uploaded
+// in parts of partSize bytes: the MD5 of the parts' MD5s, then the number of
+// parts.
+func (f *file) multipartETag(partSize int64) (string, error) {
+	in, err := f.open()
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	sums := md5.New()
+	parts := 0
+	for {
+		part := md5.New()
+		n, err := io.CopyN(part, in, partSize)
+		if n > 0 {
+			sums.Write(part.Sum(nil))
+			parts++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(sums.Sum(nil)) + "-" + strconv.Itoa(parts), nil
+}
+
+// commonPartSizes are the part sizes other tools upload in by default: the
+// AWS CLI's, s3cmd's, and rclone's.
+var commonPartSizes = []int64{8 << 20, 15 << 20, 5 << 20}
+
+// etagMatches reports whether etag, the ETag of an object uploaded in parts,
+// is that of f's contents. The part size isn't recorded, so it tries the
+// size Run uses, those of other common tools, and the smallest whole number
+// of MiB that makes as many parts, when they'd make the right number.
+func (r *mirrorRun) etagMatches(etag string, f *file) (bool, error) {
+	i := strings.LastIndexByte(etag, '-')
+	parts, err := strconv.ParseInt(etag[i+1:], 10, 64)
+	if err != nil || parts < 1 {
+		return false, nil
+	}
+	const mib = 1 << 20
+	inferred := (f.size + parts - 1) / parts
+	inferred = (inferred + mib - 1) / mib * mib
+	tried := map[int64]bool{}
+	for _, partSize := range append([]int64{r.uploadPartSize(f.size), inferred}, commonPartSizes...) {
+		if tried[partSize] {
+			continue
+		}
+		tried[partSize] = true
+		if partSize <= 0 || (f.size+partSize-1)/partSize != parts {
+			continue
+		}
+		computed, err := f.multipartETag(partSize)
+		if err != nil {
+			return false, fmt.Errorf("compute multipart ETag: %w", err)
+		}
+		if computed == etag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
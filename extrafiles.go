@@ -0,0 +1,74 @@
+package mirror2s3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// WithExtraFiles makes Run upload files that aren't in the git tree, such as
+// generated build information, along with the site. files maps each file's
+// name within the site to its contents. They're compared with the bucket
+// and given content types, headers and derived files like any other, aren't
+// pruned, and are uploaded even when WithOnlyFiles or WithDiffRange limits
+// which of the site's files are. It's an error for the site to have a file of
+// the same name.
+func WithExtraFiles(files map[string][]byte) func(*Mirror) {
+	return func(m *Mirror) {
+		if m.extraFiles == nil {
+			m.extraFiles = map[string][]byte{}
+		}
+		for name, data := range files {
+			m.extraFiles[normalizePath(name)] = data
+		}
+	}
+}
+
+// extraFileNames returns the names of the extra files, sorted.
+func (m *Mirror) extraFileNames() []string {
+	names := make([]string, 0, len(m.extraFiles))
+	for name := range m.extraFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkExtraFileNames returns an error if an extra file's name can't be a
+// file in the site.
+func (m *Mirror) checkExtraFileNames() error {
+	for _, name := range m.extraFileNames() {
+		if name == "" || name[len(name)-1] == '/' {
+			return fmt.Errorf(`extra file "%s" has no file name`, name)
+		}
+		if rule := ignoreRule(name); rule != "" {
+			return fmt.Errorf(`extra file "%s" matches ignore rule "%s"`, name, rule)
+		}
+	}
+	return nil
+}
+
+// planExtraFiles adds the extra files to p.
+func (m *Mirror) planExtraFiles(p *plan) error {
+	for _, name := range m.extraFileNames() {
+		key, size := m.siteKey(name), int64(len(m.extraFiles[name]))
+		if err := checkSize(key, size); err != nil {
+			return err
+		}
+		if m.rewritesFiles() {
+			size = -1
+		}
+		p.addKey(m, name, key, size)
+	}
+	return nil
+}
+
+// sendExtraFiles sends the extra files to files.
+func (m *Mirror) sendExtraFiles(ctx context.Context, plan *plan, files chan<- *file) error {
+	for _, name := range m.extraFileNames() {
+		if err := m.sendFile(ctx, plan, name, m.extraFiles[name], files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package mirror2s3
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WithExclude makes Run skip the files in the site matching any of the
+// patterns, as if they matched IgnoredFiles, such as "drafts/" or "*.md".
+// Patterns are matched like the lines of a .gitignore, so "!" re-includes
+// files an earlier pattern excluded. Objects for excluded files are kept
+// when pruning, unless WithPruneIgnored is set.
+func WithExclude(patterns ...string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.filter.exclude = append(m.filter.exclude, parseGitignore(strings.Join(patterns, "\n"))...)
+	}
+}
+
+// WithInclude makes Run skip the files in the site that don't match any of
+// the patterns, which are matched like those of WithExclude. A file must be
+// included and not excluded to be uploaded.
+func WithInclude(patterns ...string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.filter.include = append(m.filter.include, parseGitignore(strings.Join(patterns, "\n"))...)
+	}
+}
+
+// fileFilter is the patterns set by WithExclude and WithInclude.
+type fileFilter struct {
+	exclude, include gitignore
+}
+
+// rule returns the pattern that keeps the file at name from being uploaded,
+// or "" if there isn't one.
+func (f fileFilter) rule(name string) string {
+	if rule := f.exclude.match(name); rule != "" {
+		return rule
+	}
+	if len(f.include) > 0 && f.include.match(name) == "" {
+		return "not included"
+	}
+	return ""
+}
+
+// check returns an error if any of the patterns is malformed.
+func (f fileFilter) check() error {
+	for _, patterns := range []gitignore{f.exclude, f.include} {
+		for _, p := range patterns {
+			if err := checkGlobs([]string{p.glob}); err != nil {
+				return fmt.Errorf(`pattern "%s": %w`, p.line, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package mirror2s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"path"
+)
+
+// fingerprintLength is how many hex digits of a file's MD5 its fingerprint
+// has.
+const fingerprintLength = 10
+
+// WithFingerprint makes Run upload the files whose names in the site match
+// any of patterns under names that include a hash of their contents, so that
+// they can be cached forever: "app.js" is uploaded as "app.0123456789.js".
+// Patterns are glob patterns, like "assets/**/*.js". Result.Fingerprints maps
+// the files' names to their fingerprinted names, for the caller to rewrite
+// references to them; Run doesn't change the files that refer to them.
+// Combine it with WithImmutableHashedAssets to set their Cache-Control.
+//
+// Each change to a file adds a new object, and the old ones are only deleted
+// by WithPrune; WithPruneOlderThan keeps them around for pages that are still
+// cached. It can't be combined with WithDeleteBeforeUpload, and Diff and
+// WithDiffRange deal in the files' names, not their fingerprinted names.
+func WithFingerprint(patterns ...string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.fingerprint = append(m.fingerprint, patterns...)
+	}
+}
+
+// fingerprintName returns what the file at name, with the given contents, is
+// uploaded as, which is name itself unless it's to be fingerprinted.
+func (m *Mirror) fingerprintName(name string, sum [md5.Size]byte) string {
+	if firstMatch(m.fingerprint, name) == "" {
+		return name
+	}
+	ext := path.Ext(name)
+	return name[:len(name)-len(ext)] + "." + hex.EncodeToString(sum[:])[:fingerprintLength] + ext
+}
+
+// recordFingerprint notes f's fingerprinted name in the result, if it has one.
+func (r *mirrorRun) recordFingerprint(f *file) {
+	if f.original == "" {
+		return
+	}
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	if r.res.Fingerprints == nil {
+		r.res.Fingerprints = map[string]string{}
+	}
+	r.res.Fingerprints[f.original] = f.key[len(r.keyPrefix):]
+}
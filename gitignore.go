@@ -0,0 +1,113 @@
+package mirror2s3
+
+import (
+	"path"
+	"strings"
+)
+
+// WithHonorGitignore makes Run skip the files in the site that match the
+// patterns in the .gitignore at the root of the site, as if they matched
+// IgnoredFiles. Git itself only uses .gitignore to keep untracked files out of
+// the repository; files that were committed anyway, or added before the
+// pattern was, are still archived, and this keeps them out of the bucket too.
+// Only the root .gitignore is read, and patterns are matched as git matches
+// them, except that a negated pattern re-includes files even when their
+// directory is ignored.
+func WithHonorGitignore(honor bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.honorGitignore = honor
+	}
+}
+
+// gitignore is the patterns in a .gitignore file, in order.
+type gitignore []gitignorePattern
+
+type gitignorePattern struct {
+	// line is the pattern as written, for explaining what it matched.
+	line string
+	// glob is the pattern for matchGlob, without any "!", leading "/", or
+	// trailing "/".
+	glob string
+	// negate is whether the pattern started with "!", re-including files.
+	negate bool
+	// dirOnly is whether the pattern ended with "/", matching directories.
+	dirOnly bool
+	// anchored is whether the pattern had a "/" before its end, making it
+	// relative to the root rather than matching names at any depth.
+	anchored bool
+}
+
+// readGitignore reads the .gitignore at the root of treeish, returning nil if
+// there isn't one.
+func (m *Mirror) readGitignore(treeish string) (gitignore, error) {
+	data, ok, err := m.readSiteFile(treeish, ".gitignore")
+	if !ok || err != nil {
+		return nil, err
+	}
+	return parseGitignore(data), nil
+}
+
+// parseGitignore parses the contents of a .gitignore file.
+func parseGitignore(data string) gitignore {
+	var g gitignore
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " ")
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p := gitignorePattern{line: line}
+		glob := line
+		if glob[0] == '!' {
+			p.negate, glob = true, glob[1:]
+		} else if strings.HasPrefix(glob, `\!`) || strings.HasPrefix(glob, `\#`) {
+			glob = glob[1:]
+		}
+		if strings.HasSuffix(glob, "/") {
+			p.dirOnly, glob = true, strings.TrimRight(glob, "/")
+		}
+		p.anchored = strings.Contains(glob, "/")
+		p.glob = strings.TrimPrefix(glob, "/")
+		if p.glob != "" {
+			g = append(g, p)
+		}
+	}
+	return g
+}
+
+// match returns the pattern that ignores the file at name, or "" if none
+// does. As in git, the last pattern to match decides.
+func (g gitignore) match(name string) string {
+	rule := ""
+	for _, p := range g {
+		if p.matches(name) {
+			if p.negate {
+				rule = ""
+			} else {
+				rule = p.line
+			}
+		}
+	}
+	return rule
+}
+
+// matches reports whether p matches the file at name or any of the
+// directories it's in.
+func (p *gitignorePattern) matches(name string) bool {
+	segments := strings.Split(name, "/")
+	for i := 1; i <= len(segments); i++ {
+		if p.dirOnly && i == len(segments) {
+			break
+		}
+		if p.anchored {
+			if matchGlob(p.glob, strings.Join(segments[:i], "/")) {
+				return true
+			}
+		} else if ok, err := path.Match(p.glob, segments[i-1]); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
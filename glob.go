@@ -0,0 +1,57 @@
+package mirror2s3
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// matchGlob reports whether key matches pattern. Within a path segment,
+// patterns use path.Match syntax; a "**" segment matches any number of
+// segments, so "assets/**" matches everything under assets/.
+func matchGlob(pattern, key string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(key, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// checkGlobs returns an error if any of the patterns is malformed.
+func checkGlobs(patterns []string) error {
+	for _, pattern := range patterns {
+		for _, segment := range strings.Split(pattern, "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return fmt.Errorf(`bad pattern "%s": %w`, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// firstMatch returns the first of patterns that key matches, or "" if none do.
+func firstMatch(patterns []string, key string) string {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, key) {
+			return pattern
+		}
+	}
+	return ""
+}
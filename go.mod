@@ -1,5 +1,10 @@
 module github.com/alltom/mirror2s3
 
-go 1.12
+go 1.13
 
-require gocloud.dev v0.17.0
+require (
+	github.com/andybalholm/brotli v1.0.4
+	github.com/aws/aws-sdk-go v1.19.45
+	gocloud.dev v0.17.0
+	gopkg.in/yaml.v2 v2.4.0
+)
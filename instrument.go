@@ -0,0 +1,51 @@
+package mirror2s3
+
+import (
+	"context"
+	"time"
+)
+
+// Instrumentation receives spans and measurements from Run, so they can be
+// passed on to a tracing or metrics system such as OpenTelemetry or
+// Prometheus. Its methods may be called from several goroutines at once.
+type Instrumentation interface {
+	// StartSpan starts a span for an operation: "archive" for reading the
+	// site from git, "list" for listing the bucket, and "upload" for
+	// uploading one file, named by key. The returned context is used for
+	// the operation.
+	StartSpan(ctx context.Context, name, key string) (context.Context, Span)
+	// RecordUpload records that a file of size bytes was uploaded to key in
+	// d.
+	RecordUpload(key string, size int64, d time.Duration)
+}
+
+// Span is an operation started by Instrumentation.StartSpan.
+type Span interface {
+	// End ends the span. err is the operation's error, if it failed.
+	End(err error)
+}
+
+// WithInstrumentation makes Run report spans and measurements to in. By
+// default, and if in is nil, they aren't reported.
+func WithInstrumentation(in Instrumentation) func(*Mirror) {
+	return func(m *Mirror) {
+		if in == nil {
+			in = nopInstrumentation{}
+		}
+		m.instrumentation = in
+	}
+}
+
+// nopInstrumentation is the Instrumentation Run uses by default. It does
+// nothing.
+type nopInstrumentation struct{}
+
+func (nopInstrumentation) StartSpan(ctx context.Context, name, key string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+func (nopInstrumentation) RecordUpload(key string, size int64, d time.Duration) {}
+
+type nopSpan struct{}
+
+func (nopSpan) End(err error) {}
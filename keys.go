@@ -0,0 +1,133 @@
+package mirror2s3
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DuplicateKeyMode controls what Run does when two files in the site map to
+// the same key, such as "a//b.html" and "a/b.html", or a file "x.gz" and the
+// gzipped copy of "x".
+type DuplicateKeyMode int
+
+const (
+	// DuplicateKeyLastWins uploads the last of the files, in the order Run
+	// reads them: the order of the archive, with the files derived from each
+	// file right after it, then the extra files. This is the default.
+	DuplicateKeyLastWins DuplicateKeyMode = iota
+	// DuplicateKeyFirstWins uploads the first of the files.
+	DuplicateKeyFirstWins
+	// DuplicateKeyError fails the Run, before changing anything if the keys
+	// are known from the archive's file names alone.
+	DuplicateKeyError
+)
+
+// WithDuplicateKeyMode sets what Run does when two files map to the same key.
+// Whatever the mode, duplicates are logged.
+func WithDuplicateKeyMode(mode DuplicateKeyMode) func(*Mirror) {
+	return func(m *Mirror) {
+		m.duplicateKeys = mode
+	}
+}
+
+// maxKeyLength is the longest key S3 allows, in bytes.
+const maxKeyLength = 1024
+
+// unsafeChars are the characters AWS recommends avoiding in keys, as they're
+// mangled by some clients and CDNs, CloudFront among them.
+const unsafeChars = "\\{}^%`[]\"<>~#|"
+
+// checkKeys looks for planned keys that are probably mistakes. Problems are
+// logged, or returned as an error if strict keys are enabled.
+func (m *Mirror) checkKeys(keys []string) error {
+	var problems []string
+	seen := map[string]bool{}
+	var unique []string
+	for _, key := range keys {
+		if seen[key] {
+			if m.duplicateKeys == DuplicateKeyError {
+				return fmt.Errorf(`check keys: more than one file maps to the key "%s"`, key)
+			}
+			// The duplicate is logged when it's uploaded.
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, key)
+		// S3 rejects these keys, so they're errors even if keys aren't strict.
+		if len(key) > maxKeyLength {
+			return fmt.Errorf(`check keys: key "%s" is %d bytes, more than the limit of %d`, key, len(key), maxKeyLength)
+		}
+		if !utf8.ValidString(key) {
+			return fmt.Errorf("check keys: key %q isn't valid UTF-8", key)
+		}
+		if problem := unsafeKey(key); problem != "" {
+			problems = append(problems, fmt.Sprintf(`key "%s" %s`, key, problem))
+		}
+	}
+	for _, group := range caseCollisions(unique) {
+		problems = append(problems, fmt.Sprintf("keys differ only by case: %s", strings.Join(group, ", ")))
+	}
+
+	for _, problem := range problems {
+		if m.strictKeys {
+			return fmt.Errorf("check keys: %s", problem)
+		}
+		m.logf("warning: %s", problem)
+	}
+	return nil
+}
+
+// isDuplicate reports whether f has the same key as a file already read, in
+// sent, and should be skipped. It returns an error if duplicates aren't
+// allowed.
+func (r *mirrorRun) isDuplicate(sent map[string]bool, f *file) (bool, error) {
+	if !sent[f.key] {
+		return false, nil
+	}
+	switch r.duplicateKeys {
+	case DuplicateKeyError:
+		return false, fmt.Errorf(`more than one file maps to the key "%s"`, f.key)
+	case DuplicateKeyFirstWins:
+		r.logf("warning: skipping %s, an earlier file has the same key…", f.key)
+		return true, nil
+	default:
+		r.logf("warning: replacing %s, a later file has the same key…", f.key)
+		return false, nil
+	}
+}
+
+// unsafeKey returns why key may not work everywhere, or "" if it should.
+func unsafeKey(key string) string {
+	for _, c := range key {
+		switch {
+		case c < 0x20 || c == 0x7f:
+			return fmt.Sprintf("has the control character %q", c)
+		case strings.ContainsRune(unsafeChars, c):
+			return fmt.Sprintf("has the character %q, which some clients and CDNs mangle", c)
+		}
+	}
+	return ""
+}
+
+// caseCollisions returns each group of keys that are equal when compared
+// case-insensitively. S3 treats them as distinct objects, but a site authored
+// on a case-insensitive file system almost certainly meant them to be one.
+func caseCollisions(keys []string) [][]string {
+	byFolded := map[string][]string{}
+	for _, key := range keys {
+		folded := strings.ToLower(key)
+		byFolded[folded] = append(byFolded[folded], key)
+	}
+
+	var groups [][]string
+	for _, group := range byFolded {
+		if len(group) > 1 {
+			sort.Strings(group)
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups
+}
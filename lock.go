@@ -0,0 +1,189 @@
+package mirror2s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"gocloud.dev/gcerrors"
+)
+
+const (
+	// lockKey is where the lock is kept, under the key prefix.
+	lockKey = internalDir + "lock"
+	// defaultLockTTL is how long a lock lasts if WithLockTTL isn't used.
+	defaultLockTTL = 10 * time.Minute
+	// lockSettle is how long acquireLock waits before checking that it won.
+	// Another Run that read the lock before it was written will have written
+	// its own lock by then, so only the last writer sees its own token.
+	lockSettle = 2 * time.Second
+)
+
+// lockInfo is the contents of the lock object.
+type lockInfo struct {
+	Token   string    `json:"token"`
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// bucketLock is a lock held by this Run.
+type bucketLock struct {
+	r    *mirrorRun
+	key  string
+	info lockInfo
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquireLock takes the lock on the bucket, returning ErrLocked if another
+// Run has it. A lock that hasn't been refreshed within its TTL is assumed to
+// belong to a Run that crashed, and is taken over.
+//
+// S3 can't create an object only if it doesn't exist, so two Runs that start
+// within lockSettle of each other could both succeed; the lock guards against
+// overlapping deploys, not simultaneous ones.
+func (r *mirrorRun) acquireLock(ctx context.Context) (*bucketLock, error) {
+	key := r.keyPrefix + lockKey
+	held, err := r.readLock(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if held != nil {
+		if r.clock.Now().Before(held.Expires) {
+			r.logf("%s holds the lock until %s", held.Holder, held.Expires.Format(time.RFC3339))
+			return nil, ErrLocked
+		}
+		r.logf("taking over the lock, %s let it expire at %s…", held.Holder, held.Expires.Format(time.RFC3339))
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("make lock token: %w", err)
+	}
+	holder, _ := os.Hostname()
+	l := &bucketLock{
+		r:    r,
+		key:  key,
+		info: lockInfo{Token: hex.EncodeToString(token), Holder: fmt.Sprintf("%s (pid %d)", holder, os.Getpid())},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := l.write(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := sleep(ctx, r.clock, lockSettle); err != nil {
+		l.abandon()
+		return nil, err
+	}
+	if held, err := r.readLock(ctx, key); err != nil {
+		l.abandon()
+		return nil, err
+	} else if held == nil || held.Token != l.info.Token {
+		return nil, ErrLocked
+	}
+
+	go l.refresh()
+	return l, nil
+}
+
+// readLock returns the lock at key, or nil if there isn't one.
+func (r *mirrorRun) readLock(ctx context.Context, key string) (*lockInfo, error) {
+	r.countRequest(&r.res.Requests.Gets)
+	data, err := r.bucket.ReadAll(ctx, key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read lock: %w", err)
+	}
+	var info lockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		// Whatever this is, it isn't protecting anything.
+		r.logf("warning: ignoring malformed lock: %v", err)
+		return nil, nil
+	}
+	return &info, nil
+}
+
+// write writes the lock with a fresh expiry time.
+func (l *bucketLock) write(ctx context.Context) error {
+	l.info.Expires = l.r.clock.Now().Add(l.r.lockTTL)
+	data, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	l.r.countRequest(&l.r.res.Requests.Puts)
+	if err := l.r.bucket.WriteAll(ctx, l.key, data, nil); err != nil {
+		return fmt.Errorf("write lock: %w", err)
+	}
+	return nil
+}
+
+// refresh keeps the lock from expiring until release is called.
+func (l *bucketLock) refresh() {
+	defer close(l.done)
+	interval := l.r.lockTTL / 3
+	if interval <= 0 {
+		interval = l.r.lockTTL
+	}
+	tick, stop := l.r.clock.Tick(interval)
+	defer stop()
+	for {
+		select {
+		case <-tick:
+			if err := l.write(context.Background()); err != nil {
+				l.r.logf("warning: refresh lock: %v", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// release gives up the lock, unless another Run has taken it over.
+func (l *bucketLock) release(ctx context.Context) error {
+	close(l.stop)
+	<-l.done
+	held, err := l.drop(ctx)
+	if err == nil && !held {
+		l.r.logf("warning: lost the lock before finishing")
+	}
+	return err
+}
+
+// abandon gives up a lock acquireLock wrote but failed to take, so that the
+// next Run doesn't have to wait for it to expire. ctx may be done, so it's
+// not used.
+func (l *bucketLock) abandon() {
+	if _, err := l.drop(context.Background()); err != nil {
+		l.r.logf("warning: remove abandoned lock: %v", err)
+	}
+}
+
+// drop deletes the lock, or expires it if deletes are disabled, unless
+// another Run has taken it over. It reports whether the lock was still held.
+func (l *bucketLock) drop(ctx context.Context) (bool, error) {
+	held, err := l.r.readLock(ctx, l.key)
+	if err != nil {
+		return false, err
+	}
+	if held == nil || held.Token != l.info.Token {
+		return false, nil
+	}
+	if l.r.noDelete {
+		// Leave an expired lock rather than deleting it.
+		l.info.Expires = l.r.clock.Now()
+		data, err := json.Marshal(l.info)
+		if err != nil {
+			return true, err
+		}
+		l.r.countRequest(&l.r.res.Requests.Puts)
+		return true, l.r.bucket.WriteAll(ctx, l.key, data, nil)
+	}
+	return true, l.r.deleteObject(ctx, l.key)
+}
@@ -0,0 +1,77 @@
+package mirror2s3
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLockExpires(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	const ttl = 10 * time.Minute
+	first := newTestRun(WithLockTTL(ttl), withClock(clock))
+	defer first.bucket.Close()
+	l, err := first.acquireLock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Duration{lockSettle}; !reflect.DeepEqual(clock.Waits(), want) {
+		t.Errorf("acquiring the lock waited %v, want %v", clock.Waits(), want)
+	}
+	// Stop refreshing the lock without releasing it, like a Run that
+	// crashed.
+	close(l.stop)
+	<-l.done
+
+	second := newTestRun(WithLockTTL(ttl), withClock(clock))
+	second.bucket = first.bucket
+	if _, err := second.acquireLock(ctx); err != ErrLocked {
+		t.Fatalf("acquiring a held lock returned %v, want ErrLocked", err)
+	}
+	clock.Advance(ttl)
+	l, err = second.acquireLock(ctx)
+	if err != nil {
+		t.Fatalf("acquiring an expired lock: %v", err)
+	}
+	if err := l.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := second.readLock(ctx, l.key); err != nil || held != nil {
+		t.Errorf("after release, lock is %+v, %v, want none", held, err)
+	}
+}
+
+func TestLockRefreshes(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	const ttl = 9 * time.Minute
+	r := newTestRun(WithLockTTL(ttl), withClock(clock))
+	defer r.bucket.Close()
+	l, err := r.acquireLock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.release(ctx)
+
+	// The lock is refreshed every third of its TTL, in the background.
+	if !clock.WaitForTicker() {
+		t.Fatal("the lock isn't being refreshed")
+	}
+	clock.Advance(ttl / 3)
+	want := clock.Now().Add(ttl)
+	var held *lockInfo
+	for deadline := time.Now().Add(time.Second); ; {
+		if held, err = r.readLock(ctx, l.key); err != nil {
+			t.Fatal(err)
+		}
+		if held.Expires.Equal(want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lock expires at %v, want %v", held.Expires, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
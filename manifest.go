@@ -0,0 +1,155 @@
+package mirror2s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// manifestKey is where WithManifestChecksums keeps the manifest, under the
+// key prefix. It's under internalDir, so it's never pruned.
+const manifestKey = internalDir + "manifest.json"
+
+// manifestEntry is what the manifest records about an object.
+type manifestEntry struct {
+	// SHA256 is the checksum of the object's contents, in hex.
+	SHA256 string `json:"sha256"`
+	// Commit is the commit the contents were first uploaded from, or "" if
+	// they weren't uploaded from a commit.
+	Commit string `json:"commit,omitempty"`
+}
+
+// WithManifestChecksums makes Run keep a manifest in the bucket of the
+// SHA-256 of every object it uploads, and the commit it was uploaded from,
+// and compare files against that instead of listing the bucket. A Run which
+// changes nothing costs one request plus one per deleted file, and objects
+// whose listed MD5s are unusable, such as multipart uploads and objects
+// encrypted with SSE-KMS, are still skipped when they're unchanged. If
+// there's no manifest, as on the first Run, or it can't be read, Run lists
+// the bucket instead, and writes a new one.
+//
+// Pruning deletes the objects in the manifest that are no longer in the site,
+// again without listing the bucket, unless WithPruneOlderThan needs to know
+// when they were uploaded. The new manifest is only written once every upload
+// and delete has succeeded.
+//
+// The manifest is only as accurate as the last Run leaves it: objects
+// changed or added by anything else are not noticed, or pruned, until the
+// next Run that lists the bucket.
+func WithManifestChecksums(manifest bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.manifestChecksums = manifest
+	}
+}
+
+// readManifest reads the manifest into r.remote. If there's no usable
+// manifest, it logs why and leaves r.remote nil.
+func (r *mirrorRun) readManifest(ctx context.Context) error {
+	key := r.keyPrefix + manifestKey
+	r.countRequest(&r.res.Requests.Gets)
+	data, err := r.bucket.ReadAll(ctx, key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		r.logf("no manifest at %s, listing the bucket…", key)
+		return nil
+	}
+	if err != nil {
+		return &UploadError{Op: "read manifest", Key: key, Err: err}
+	}
+
+	entries, err := parseManifest(data)
+	if err != nil {
+		r.logf("warning: ignoring the manifest at %s, it's corrupt: %v", key, err)
+		return nil
+	}
+	remote := make(map[string]*object, len(entries))
+	for name, entry := range entries {
+		if _, err := hex.DecodeString(entry.SHA256); err != nil || len(entry.SHA256) != 2*sha256.Size {
+			r.logf("warning: ignoring the manifest at %s, it has a bad checksum for %s", key, name)
+			return nil
+		}
+		remote[r.keyPrefix+name] = &object{key: r.keyPrefix + name, sha256: entry.SHA256, commit: entry.Commit}
+	}
+	r.remote = remote
+	r.fromManifest = true
+	return nil
+}
+
+// parseManifest parses a manifest, which maps names relative to the key
+// prefix to manifest entries. Manifests written before commits were
+// recorded map names to checksums alone.
+func parseManifest(data []byte) (map[string]manifestEntry, error) {
+	var entries map[string]manifestEntry
+	err := json.Unmarshal(data, &entries)
+	if err == nil {
+		return entries, nil
+	}
+	var sums map[string]string
+	if json.Unmarshal(data, &sums) != nil {
+		return nil, err
+	}
+	entries = make(map[string]manifestEntry, len(sums))
+	for name, sum := range sums {
+		entries[name] = manifestEntry{SHA256: sum}
+	}
+	return entries, nil
+}
+
+// recordChecksum notes f's checksum for the manifest, and the commit it was
+// uploaded from: the manifest's, if obj, its object, is in the manifest with
+// the same contents, or otherwise the Run's.
+func (r *mirrorRun) recordChecksum(f *file, obj *object) {
+	if !r.manifestChecksums {
+		return
+	}
+	entry := manifestEntry{SHA256: hex.EncodeToString(f.sha256), Commit: r.res.CommitSHA}
+	if obj != nil && obj.sha256 == entry.SHA256 && obj.commit != "" {
+		entry.Commit = obj.commit
+	}
+	r.resMu.Lock()
+	r.checksums[f.key] = entry
+	r.resMu.Unlock()
+}
+
+// writeManifest writes the manifest of the files uploaded or found
+// unchanged. When only some of the site was mirrored, the previous manifest's
+// entries for the rest are kept, less any that were deleted.
+func (r *mirrorRun) writeManifest(ctx context.Context) error {
+	entries := map[string]manifestEntry{}
+	if r.fromManifest && (r.only != nil || r.diffFrom != "") {
+		for key, obj := range r.remote {
+			entries[strings.TrimPrefix(key, r.keyPrefix)] = manifestEntry{SHA256: obj.sha256, Commit: obj.commit}
+		}
+		r.resMu.Lock()
+		for _, key := range r.res.Deleted {
+			delete(entries, strings.TrimPrefix(key, r.keyPrefix))
+		}
+		r.resMu.Unlock()
+	}
+	for key, entry := range r.checksums {
+		entries[strings.TrimPrefix(key, r.keyPrefix)] = entry
+	}
+	if r.dryRun {
+		r.logf("would write the manifest of %d files…", len(entries))
+		return nil
+	}
+
+	// json.Marshal sorts the keys, so unchanged sites get identical
+	// manifests.
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	key := r.keyPrefix + manifestKey
+	r.logf("writing the manifest of %d files…", len(entries))
+	r.countRequest(&r.res.Requests.Puts)
+	opts := &blob.WriterOptions{ContentType: "application/json"}
+	if err := r.bucket.WriteAll(ctx, key, data, opts); err != nil {
+		return &UploadError{Op: "write manifest", Key: key, Err: err}
+	}
+	return nil
+}
@@ -5,35 +5,159 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"gocloud.dev/blob"
-	_ "gocloud.dev/blob/s3blob"
+	"gocloud.dev/blob/s3blob"
 	"io"
 	"io/ioutil"
 	"log"
-	"mime"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	IgnoredFiles = map[string]struct{}{
-		".gitignore": struct{}{},
+		".gitignore":  struct{}{},
+		".gitmodules": struct{}{},
 	}
 )
 
 type Mirror struct {
-	gitPath string
-	siteSourcePath string
-	awsProfile     string
-	awsRegion      string
-	bucketURL      string
+	gitPath            string
+	gitRef             string
+	gitDir             string
+	workTree           string
+	siteSourcePath     string
+	directorySource    string
+	submodules         bool
+	objectRules        []Rule
+	filter             fileFilter
+	retryPolicy        RetryPolicy
+	distributionID     string
+	progress           func(Progress)
+	keyPrefix          string
+	branchPrefix       bool
+	awsProfile         string
+	awsRegion          string
+	managedAWSEnv      bool
+	autoRegion         bool
+	bucketURL          string
+	strictKeys         bool
+	duplicateKeys      DuplicateKeyMode
+	failOnEmpty        bool
+	requireEmpty       bool
+	directoryIndex     DirectoryIndexMode
+	cleanURLs          CleanURLMode
+	redirectsFile      string
+	checksum           ChecksumAlgorithm
+	manifestChecksums  bool
+	prune              bool
+	deleteBeforeUpload bool
+	pruneIgnored       bool
+	pruneOlderThan     time.Duration
+	deleteThreshold    float64
+	forcePrune         bool
+	noDelete           bool
+	protectedKeys      []string
+	followHardlinks    bool
+	honorGitignore     bool
+	skipEmptyFiles     bool
+	keepPaths          bool
+	onlyFiles          map[string]bool
+	diffFrom           string
+	sizeFallback       bool
+	shouldUpload       func(key string, localMD5, remoteMD5 []byte, size int64) bool
+	concurrency        int
+	partSize           int
+	maxUploads         int
+	maxUploadBytes     int64
+	lowMemory          bool
+	listDelimiter      string
+	listPageSize       int
+	shallow            bool
+	fingerprint        []string
+	gzipSiblings       bool
+	gzipExclude        []string
+	varyAcceptEncoding bool
+	transforms         []Rewrite
+	movesFiles         bool
+	verify             bool
+	streamThreshold    int64
+	compression        Compression
+	compressMinSize    int
+	extraFiles         map[string][]byte
+	archiveFormat      ArchiveFormat
+	contentTypes       map[string]string
+	mimeTypesFile      string
+	noContentType      bool
+	reconcileTypes     bool
+	contentLanguage    func(key string) string
+	cacheControl       string
+	hashedAssets       *regexp.Regexp
+	acl                string
+	aclByExtension     map[string]string
+	errorDocument      string
+	configWebsite      bool
+	lock               bool
+	lockTTL            time.Duration
+	beforeRun          []func(context.Context) error
+	afterRun           []func(context.Context, *Result, error) error
+	logger             Logger
+	staged             bool
+	dryRun             bool
+	planFormat         PlanFormat
+	planOutput         io.Writer
+	instrumentation    Instrumentation
+
+	clock clock
+	// rand provides the jitter of retries' delays.
+	rand *lockedRand
+
+	watchDebounce time.Duration
+	watchFetch    string
+	// watchChecks receives a value when WatchHandler asks Watch to check
+	// the ref.
+	watchChecks chan struct{}
+
+	// ctx is the context set by WithContext.
+	ctx context.Context
+
+	// mu guards the state set up by the first Run: bucket, which is opened
+	// unless the caller provided one with WithBucket, fileContentTypes, which
+	// is read from the mime types file, and the branch prefix.
+	mu               sync.Mutex
+	bucket           *blob.Bucket
+	ownsBucket       bool
+	fileContentTypes map[string]string
+	// branchResolved is whether the branch has been added to keyPrefix, and
+	// previewBase is what keyPrefix was before.
+	branchResolved bool
+	previewBase    string
 }
 
 func New(options ...func(*Mirror)) *Mirror {
 	m := &Mirror{
-		gitPath : "/usr/bin/git",
+		gitPath:         "/usr/bin/git",
+		gitRef:          "HEAD",
+		concurrency:     1,
+		failOnEmpty:     true,
+		managedAWSEnv:   true,
+		lockTTL:         defaultLockTTL,
+		clock:           realClock{},
+		rand:            newLockedRand(time.Now().UnixNano()),
+		instrumentation: nopInstrumentation{},
+		watchChecks:     make(chan struct{}, 1),
 	}
 	for _, opt := range options {
 		opt(m)
@@ -47,20 +171,64 @@ func WithGitRepoRoot(path string) func(*Mirror) {
 	}
 }
 
-// Example: example.com
+// WithGitRef sets what to mirror, which can be anything git archive accepts:
+// a branch, tag, or commit, or a directory within one. The default is HEAD.
+// Example: refs/tags/v1.2.0, origin/main, HEAD:website
+func WithGitRef(ref string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.gitRef = ref
+	}
+}
+
+// WithGitDir sets the repository git reads from (git --git-dir), for bare
+// repos or worktrees where running git in the repo root isn't enough. The ref
+// given to WithGitRef is resolved in this repository.
+func WithGitDir(dir string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.gitDir = dir
+	}
+}
+
+// WithWorkTree sets the working tree git uses (git --work-tree). The archive
+// is always made from committed objects, so this only changes which
+// .gitattributes git consults. It requires WithGitDir or WithGitRepoRoot.
+func WithWorkTree(dir string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.workTree = dir
+	}
+}
+
+// WithAwsProfile sets the AWS shared config profile to use, overriding
+// AWS_PROFILE. Example: example.com
 func WithAwsProfile(name string) func(*Mirror) {
 	return func(m *Mirror) {
 		m.awsProfile = name
 	}
 }
 
-// Example: us-east-1
+// WithAwsRegion sets the AWS region to use, overriding AWS_REGION and the
+// profile's region. Example: us-east-1
 func WithAwsRegion(name string) func(*Mirror) {
 	return func(m *Mirror) {
 		m.awsRegion = name
 	}
 }
 
+// WithManagedAWSEnv(false) makes Run ignore WithAwsProfile and
+// WithAwsRegion, which can't then be set, so the AWS SDK uses the
+// environment and config files as they are. Run never changes the
+// environment, and the AWS options only override it when they're set.
+//
+// Deprecated: Leaving the AWS options unset does the same.
+func WithManagedAWSEnv(managed bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.managedAWSEnv = managed
+	}
+}
+
+// WithBucketURL sets the bucket to mirror to. Besides s3:// buckets, it can
+// be a file:// directory or mem:// bucket for previews and tests, or with
+// the gcs or azure build tags, a gs:// or azblob:// bucket.
 // Example: s3://example.com
 func WithBucketURL(url string) func(*Mirror) {
 	return func(m *Mirror) {
@@ -68,94 +236,1973 @@ func WithBucketURL(url string) func(*Mirror) {
 	}
 }
 
-func (m *Mirror) Run(ctx context.Context) error {
-	os.Setenv("AWS_REGION", m.awsRegion)
-	os.Setenv("AWS_PROFILE", m.awsProfile)
+// WithKeyPrefix puts the site under prefix in the bucket, rather than at its
+// root. Run only lists, and so only prunes, objects under the prefix. A slash
+// is added to the prefix if it doesn't end with one.
+// Example: preview/
+func WithKeyPrefix(prefix string) func(*Mirror) {
+	return func(m *Mirror) {
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		m.keyPrefix = prefix
+	}
+}
 
-	bucket, err := blob.OpenBucket(ctx, m.bucketURL)
-	if err != nil {
-		return fmt.Errorf("open bucket: %v", err)
+// WithBranchPrefix puts the site under a prefix named for the branch of the
+// git ref, below the key prefix, for preview deploys of each branch. The
+// branch "feature/login" is mirrored under "feature-login/", for example. The
+// ref must be a branch, or HEAD with a branch checked out. The branch is
+// found by the first Run, and kept for later ones.
+func WithBranchPrefix(branchPrefix bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.branchPrefix = branchPrefix
 	}
-	defer bucket.Close()
+}
 
-	hashes := map[string][]byte{}
-	itr := bucket.List(nil)
-	for {
-		obj, err := itr.Next(ctx)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Fatal(err)
-		}
-		if obj.MD5 != nil {
-			hashes[obj.Key] = obj.MD5
-		}
+// WithListDelimiter makes Run treat keys below the key prefix that contain
+// delimiter as belonging to someone else: they aren't listed, uploaded, or
+// pruned.
+func WithListDelimiter(delimiter string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.listDelimiter = delimiter
 	}
+}
 
-	r, err := m.getSiteTar()
-	if err != nil {
-		return fmt.Errorf("get site tar: %v", err)
+// WithListPageSize sets how many objects Run asks S3 for in each list
+// request, from 1 to S3's maximum and default of 1000. Smaller pages take
+// more requests to list the bucket, but each returns sooner.
+func WithListPageSize(n int) func(*Mirror) {
+	return func(m *Mirror) {
+		m.listPageSize = n
 	}
+}
 
-	for {
-		header, err := r.Next()
-		if err == io.EOF {
-			break
+// WithShallow makes Run only mirror files at the top level of the site,
+// leaving "subdirectories" of the bucket alone. It's the same as
+// WithListDelimiter("/").
+func WithShallow(shallow bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.shallow = shallow
+	}
+}
+
+// WithStrictKeys makes Run fail, rather than warn, when the planned keys look
+// like a mistake, such as two keys that differ only by case, or would cause
+// trouble, such as keys with characters that CloudFront mangles. Keys S3
+// can't store, such as keys over 1024 bytes, always fail.
+func WithStrictKeys(strict bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.strictKeys = strict
+	}
+}
+
+// WithFailOnEmpty makes Run return ErrEmptyArchive, before changing anything,
+// if the site has no files to upload. It's on by default; turn it off to let
+// Run empty the bucket (with WithPrune).
+func WithFailOnEmpty(fail bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.failOnEmpty = fail
+	}
+}
+
+// WithRequireEmpty makes Run fail with ErrNotEmpty, before changing anything,
+// if there are already objects under the key prefix. It's a check for the
+// first deploy of a new site that the bucket and prefix are the right ones.
+func WithRequireEmpty(require bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.requireEmpty = require
+	}
+}
+
+// WithDirectoryIndex makes Run also upload an object at the key for each
+// directory containing an index.html, so "/blog/" can be served without S3
+// website hosting.
+func WithDirectoryIndex(mode DirectoryIndexMode) func(*Mirror) {
+	return func(m *Mirror) {
+		m.directoryIndex = mode
+	}
+}
+
+// WithChecksumAlgorithm selects how Run recognizes files that are already in
+// the bucket. The default, ChecksumMD5, needs no extra requests.
+//
+// ChecksumSHA256 keeps each SHA-256 in the user metadata "sha256"
+// (x-amz-meta-sha256), not S3's own x-amz-checksum-sha256 header, which the
+// AWS SDK Run is built with predates. S3 doesn't check the metadata against
+// what it receives. Uploads are still checked by their MD5.
+func WithChecksumAlgorithm(algo ChecksumAlgorithm) func(*Mirror) {
+	return func(m *Mirror) {
+		m.checksum = algo
+	}
+}
+
+// WithPrune makes Run delete objects that aren't part of the site after
+// uploading it. Objects Run wouldn't upload to are kept: those matching
+// WithProtectedKeys, those nested below the list delimiter, and, unless
+// WithPruneIgnored is set, those whose names match an ignore rule. See
+// WithDeleteThreshold for a guard against pruning most of the bucket.
+func WithPrune(prune bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.prune = prune
+	}
+}
+
+// WithPruneIgnored makes pruning also delete objects whose names match an
+// ignore rule, such as a .gitignore uploaded by an older version. Protected
+// keys are still kept.
+func WithPruneIgnored(pruneIgnored bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.pruneIgnored = pruneIgnored
+	}
+}
+
+// WithPruneOlderThan makes pruning keep objects modified less than age before
+// Run started, so that a stale deploy can't delete what a newer one, or
+// another process, just wrote.
+func WithPruneOlderThan(age time.Duration) func(*Mirror) {
+	return func(m *Mirror) {
+		m.pruneOlderThan = age
+	}
+}
+
+// WithDeleteThreshold makes Run fail with ErrDeleteThresholdExceeded, before
+// deleting anything, if pruning would delete more than percent of the objects
+// under the key prefix, which usually means the wrong ref or key prefix
+// rather than a site that really lost most of its files. 0, the default,
+// allows any number of deletes.
+func WithDeleteThreshold(percent float64) func(*Mirror) {
+	return func(m *Mirror) {
+		m.deleteThreshold = percent
+	}
+}
+
+// WithForcePrune makes Run prune however much of the bucket it would delete,
+// overriding WithDeleteThreshold for deploys that really do remove most of
+// the site.
+func WithForcePrune(force bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.forcePrune = force
+	}
+}
+
+// WithDeleteBeforeUpload makes Run delete objects, when pruning or deleting
+// the files removed in a diff range, before uploading the site rather than
+// after. Objects are then never in the bucket alongside their replacements,
+// which matters where storage is tight or readers mustn't see a mix of old
+// and new keys, but pages are broken between the delete and the upload:
+// anything still linking to a deleted object, including the previous version
+// of the site in caches and open tabs, stops working before the new version
+// is there. The empty site check is still made before anything is deleted.
+func WithDeleteBeforeUpload(deleteBeforeUpload bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.deleteBeforeUpload = deleteBeforeUpload
+	}
+}
+
+// WithNoDelete guarantees Run never deletes an object, whatever other options
+// are set. Use it for buckets with object locks or versioning. Objects that
+// would have been pruned are logged instead.
+func WithNoDelete(noDelete bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.noDelete = noDelete
+	}
+}
+
+// WithProtectedKeys keeps Run from ever writing or deleting objects whose keys
+// match any of the glob patterns, for objects managed outside this package.
+// Example: "robots.txt", "legal/*.pdf"
+func WithProtectedKeys(patterns ...string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.protectedKeys = append(m.protectedKeys, patterns...)
+	}
+}
+
+// WithOnlyFiles makes Run upload only the named files of the site, by their
+// paths within it, ignoring the rest, to push a few files again without
+// touching the others. They're still skipped if unchanged. Run warns about
+// names that aren't in the site. It can't be combined with WithPrune.
+func WithOnlyFiles(names ...string) func(*Mirror) {
+	return func(m *Mirror) {
+		if m.onlyFiles == nil {
+			m.onlyFiles = map[string]bool{}
 		}
-		if err != nil {
-			return fmt.Errorf("get next file in tar: %v", err)
+		for _, name := range names {
+			m.onlyFiles[name] = true
 		}
+	}
+}
 
-		if header.Typeflag != tar.TypeReg {
-			continue
+// WithDiffRange makes Run mirror only what changed between two commits, such
+// as the ones a CI system provides, instead of comparing the whole site with
+// the bucket: files added or modified in toRef are uploaded (if they're not
+// already up to date) and files removed are deleted, along with the objects
+// Run generated from them. A renamed file is treated as removed from its old
+// path and added at its new one. toRef replaces the ref set with WithGitRef,
+// and both refs must name commits, though toRef may name a directory within
+// one, like "HEAD:website", to mirror just the changes there. It can't be
+// combined with WithPrune or WithOnlyFiles.
+func WithDiffRange(fromRef, toRef string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.diffFrom = fromRef
+		m.gitRef = toRef
+	}
+}
+
+// WithNormalizePaths makes Run clean up the paths of files in the archive
+// before using them as keys: backslashes become slashes, and "./" and
+// repeated slashes are removed. It's on by default.
+func WithNormalizePaths(normalize bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.keepPaths = !normalize
+	}
+}
+
+// WithFollowHardlinks makes Run upload hard links in the archive as copies of
+// the files they link to. Otherwise they're skipped.
+func WithFollowHardlinks(follow bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.followHardlinks = follow
+	}
+}
+
+// WithSkipEmptyFiles makes Run skip empty files, such as the .keep files that
+// hold otherwise empty directories in git, as if they weren't in the site.
+// Otherwise they're uploaded as empty objects.
+func WithSkipEmptyFiles(skip bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.skipEmptyFiles = skip
+	}
+}
+
+// WithSizeFallback makes Run compare files by size when the bucket doesn't
+// list an MD5 for an object, instead of always uploading them again. If the
+// sizes match, the last few KiB of the object are read back and compared too.
+func WithSizeFallback(fallback bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.sizeFallback = fallback
+	}
+}
+
+// WithShouldUpload makes Run call shouldUpload to decide whether to upload
+// each file, instead of comparing checksums: true uploads it, and false
+// skips it. It's passed the file's key, size, and MD5, and the MD5 the bucket
+// lists for the object at the key, which is nil if there's no object or the
+// bucket doesn't list one for it. Skipped files are still kept from being
+// pruned, and still retyped by WithContentTypeReconcile.
+func WithShouldUpload(shouldUpload func(key string, localMD5, remoteMD5 []byte, size int64) bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.shouldUpload = shouldUpload
+	}
+}
+
+// WithConcurrency sets how many requests Run makes to the bucket at once
+// while uploading, pruning or fetching object metadata. The default is 1.
+func WithConcurrency(n int) func(*Mirror) {
+	return func(m *Mirror) {
+		m.concurrency = n
+	}
+}
+
+// WithPartSize sets the size of the parts Run uploads files larger than size
+// in, using S3 multipart uploads, so that a failed request only has to send
+// one part again. S3 parts must be at least 5 MiB.
+func WithPartSize(size int) func(*Mirror) {
+	return func(m *Mirror) {
+		m.partSize = size
+	}
+}
+
+// WithMaxUploads makes Run stop with an error rather than upload more than n
+// files, as a guard against runaway generated content. Unchanged files don't
+// count. The error lists the files that weren't uploaded, and
+// Result.Uploaded the ones that were. Nothing is pruned.
+func WithMaxUploads(n int) func(*Mirror) {
+	return func(m *Mirror) {
+		m.maxUploads = n
+	}
+}
+
+// WithMaxUploadBytes is like WithMaxUploads, but limits the total size of the
+// files uploaded.
+func WithMaxUploadBytes(n int64) func(*Mirror) {
+	return func(m *Mirror) {
+		m.maxUploadBytes = n
+	}
+}
+
+// WithLowMemory makes Run look up objects one at a time as it comes to each
+// file, instead of first listing the whole bucket into memory. That costs a
+// request per file rather than one per thousand objects, so it's only worth
+// it for buckets with millions of objects. Pruning still lists the bucket,
+// but streams the listing.
+func WithLowMemory(lowMemory bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.lowMemory = lowMemory
+	}
+}
+
+// WithStagedDeploy makes Run upload changed files under a staging prefix
+// within .mirror2s3/ first, and only once they've all been uploaded, copy them
+// to their keys within the bucket and delete the staged copies. A failed
+// upload then leaves the site as it was, and visitors see a mix of old and
+// new files only for as long as the copies take, rather than for the whole
+// upload. The site still isn't replaced atomically. Each changed file costs
+// an extra copy and delete request. Files over 5 GB, too large for S3 to
+// copy, are uploaded in place.
+func WithStagedDeploy(staged bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.staged = staged
+	}
+}
+
+// WithDryRun makes Run compare the site with the bucket without changing
+// anything. Result.Changes, or WithPlanFormat, shows what it would have done.
+func WithDryRun(dryRun bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.dryRun = dryRun
+	}
+}
+
+// WithPlanFormat makes Run write a list of the changes it made to the bucket,
+// or would have made in a dry run, to w when it finishes.
+func WithPlanFormat(format PlanFormat, w io.Writer) func(*Mirror) {
+	return func(m *Mirror) {
+		m.planFormat = format
+		m.planOutput = w
+	}
+}
+
+// WithGzipSiblings makes Run upload a gzipped copy of each compressible file
+// next to it, with ".gz" appended to its key and a Content-Encoding of gzip,
+// for a CDN function to serve to clients that accept gzip. Files matching
+// WithGzipExclude aren't compressed. See WithVaryAcceptEncoding too.
+func WithGzipSiblings(gzipSiblings bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.gzipSiblings = gzipSiblings
+	}
+}
+
+// WithGzipExclude keeps files whose keys match any of the glob patterns from
+// getting gzipped copies, for files that must be served byte for byte, like
+// signed manifests.
+func WithGzipExclude(patterns ...string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.gzipExclude = append(m.gzipExclude, patterns...)
+	}
+}
+
+// WithVaryAcceptEncoding marks each file that has a gzipped copy, and the copy,
+// as varying by Accept-Encoding, so that caches don't serve the gzipped copy to
+// clients that can't decompress it. S3 can't set a Vary header on objects, so
+// the mark is the user metadata "vary: Accept-Encoding", for the CDN function
+// serving the copies to turn into a Vary header.
+func WithVaryAcceptEncoding(vary bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.varyAcceptEncoding = vary
+	}
+}
+
+// WithContentTypes sets the content types of files by extension, overriding
+// both the system's MIME database and Run's own defaults for common web files
+// like .xml, .wasm, and .avif. Files whose extensions have no content type
+// anywhere are given one detected from their first 512 bytes, with
+// http.DetectContentType.
+// Example: map[string]string{".xml": "text/xml", ".md": "text/markdown"}
+func WithContentTypes(types map[string]string) func(*Mirror) {
+	return func(m *Mirror) {
+		if m.contentTypes == nil {
+			m.contentTypes = map[string]string{}
 		}
-		if _, ok := IgnoredFiles[header.Name]; ok {
-			continue
+		for ext, contentType := range types {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			m.contentTypes[strings.ToLower(ext)] = contentType
 		}
+	}
+}
 
-		data, err := ioutil.ReadAll(r)
-		if err != nil {
-			return fmt.Errorf(`read file "%s": %v`, header.Name, err)
+// WithMimeTypesFile makes Run look up content types in an Apache-style
+// mime.types file, so they don't depend on the MIME database of the machine
+// Run is on. Types set with WithContentTypes take precedence over the file's,
+// which take precedence over Run's own defaults and the system's.
+func WithMimeTypesFile(path string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.mimeTypesFile = path
+	}
+}
+
+// WithNoContentType makes Run upload objects without a Content-Type, rather
+// than one guessed from the file extension or contents, for sites whose
+// content types are set elsewhere, such as by a CDN function.
+func WithNoContentType(noContentType bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.noContentType = noContentType
+	}
+}
+
+// WithContentTypeReconcile makes Run upload files again if their content is
+// up to date in the bucket but their content type isn't, such as after
+// changing WithContentTypes. It costs a request per file already in the
+// bucket to read its content type.
+func WithContentTypeReconcile(reconcile bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.reconcileTypes = reconcile
+	}
+}
+
+// WithContentLanguageFromPath sets the Content-Language of each object to
+// language(key), or leaves it unset if that's "". For example, language could
+// return "fr" for keys beginning with "fr/".
+func WithContentLanguageFromPath(language func(key string) string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.contentLanguage = language
+	}
+}
+
+// WithCacheControl sets the Cache-Control of every object Run uploads, other
+// than fingerprinted files matched by WithImmutableHashedAssets.
+// Example: "public, max-age=300"
+func WithCacheControl(cacheControl string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.cacheControl = cacheControl
+	}
+}
+
+// WithImmutableHashedAssets makes Run upload files whose keys (below the key
+// prefix) match pattern with a Cache-Control that lets them be cached
+// forever, for build tools that put a hash of each file's contents in its
+// name. A nil pattern means HashedAssetPattern. Like ACLs, Cache-Control is
+// only set when a file is uploaded, not on objects that are up to date.
+func WithImmutableHashedAssets(pattern *regexp.Regexp) func(*Mirror) {
+	return func(m *Mirror) {
+		if pattern == nil {
+			pattern = HashedAssetPattern
 		}
+		m.hashedAssets = pattern
+	}
+}
+
+// WithACL sets the canned ACL of every object Run uploads, such as
+// "public-read". By default, objects get the bucket's default ACL.
+func WithACL(acl string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.acl = acl
+	}
+}
 
-		if remoteSum, ok := hashes[header.Name]; ok {
-			localSum := md5.Sum(data)
-			if bytes.Equal(localSum[:], remoteSum) {
-				log.Printf("skipping %s…", header.Name)
-				continue
+// WithACLByExtension sets the canned ACL of objects by the extension of the
+// file they come from, overriding WithACL. Files Run generates, like
+// directory indexes, get the ACL of the file they're generated from. Only
+// uploads are affected, so objects that are already up to date keep their
+// ACL.
+// Example: map[string]string{".html": "public-read", ".css": "public-read"}
+func WithACLByExtension(acls map[string]string) func(*Mirror) {
+	return func(m *Mirror) {
+		if m.aclByExtension == nil {
+			m.aclByExtension = map[string]string{}
+		}
+		for ext, acl := range acls {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
 			}
+			m.aclByExtension[strings.ToLower(ext)] = acl
 		}
+	}
+}
+
+// WithErrorDocument names the site's error page, such as "404.html", relative
+// to the key prefix. Run fails if it isn't in the site, so a deploy can't
+// leave the bucket without one.
+func WithErrorDocument(key string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.errorDocument = key
+	}
+}
+
+// WithConfigureWebsite makes Run also set the error document in the website
+// configuration of the bucket, if it's an S3 bucket with website hosting
+// enabled. The bucket's other website settings are kept. The S3 API needs the
+// bucket's name, so an S3 bucket given to WithBucket also needs its s3://
+// URL set with WithBucketURL.
+func WithConfigureWebsite(configure bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.configWebsite = configure
+	}
+}
+
+// WithLock makes Run hold a lock on the bucket (or its key prefix) while it
+// works, so that two deploys can't overlap and prune each other's files. Run
+// returns ErrLocked if another Run has the lock.
+func WithLock(lock bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.lock = lock
+	}
+}
 
-		log.Printf("uploading %s…", header.Name)
+// WithLockTTL sets how long a lock outlives the Run holding it if that Run
+// dies without releasing it. After that, the next Run takes it over. The
+// default is 10 minutes.
+func WithLockTTL(ttl time.Duration) func(*Mirror) {
+	return func(m *Mirror) {
+		m.lockTTL = ttl
+	}
+}
 
-		var options *blob.WriterOptions
-		if contentType := mime.TypeByExtension(path.Ext(header.Name)); contentType != "" {
-			options = &blob.WriterOptions{ContentType: contentType}
+// WithLogOutput makes Run write its log to w instead of the standard logger's
+// output. A nil w discards it.
+func WithLogOutput(w io.Writer) func(*Mirror) {
+	return func(m *Mirror) {
+		if w == nil {
+			w = ioutil.Discard
 		}
-		if err = bucket.WriteAll(ctx, header.Name, data, options); err != nil {
-			return fmt.Errorf("upload file: %v", err)
+		m.logger = log.New(w, "", log.LstdFlags)
+	}
+}
+
+// Logger is what Run logs its progress to; see WithLogger. *log.Logger is one.
+// Each message is a line without a trailing newline, and warnings start with
+// "warning: ".
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// WithLogger makes Run log to l instead of the standard logger, such as to
+// route its messages to a structured logger. A nil l discards them. What git
+// writes to its standard error is logged too, as messages starting "git: ".
+func WithLogger(l Logger) func(*Mirror) {
+	return func(m *Mirror) {
+		if l == nil {
+			l = log.New(ioutil.Discard, "", 0)
 		}
+		m.logger = l
 	}
+}
 
-	return nil
+// WithBeforeRun adds a function for Run to call before it does anything else,
+// such as announcing that a deploy is starting. If it returns an error, Run
+// stops and returns it.
+func WithBeforeRun(before func(ctx context.Context) error) func(*Mirror) {
+	return func(m *Mirror) {
+		m.beforeRun = append(m.beforeRun, before)
+	}
 }
 
-func (m *Mirror) getSiteTar() (*tar.Reader, error) {
-	cmd := &exec.Cmd{
-		Path:   m.gitPath,
-		Args:   []string{m.gitPath, "archive", "--format=tar", "HEAD"},
-		Env:    []string{},
-		Dir:    m.siteSourcePath,
-		Stderr: os.Stderr,
+// WithAfterRun adds a function for Run to call when it's done, whether or not
+// it succeeded, such as reporting metrics. It's passed Run's result and
+// error, and what it returns becomes Run's error, so return err to leave it
+// unchanged. Functions are called in the order they were added.
+func WithAfterRun(after func(ctx context.Context, res *Result, err error) error) func(*Mirror) {
+	return func(m *Mirror) {
+		m.afterRun = append(m.afterRun, after)
 	}
-	tarf, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("get git stdout: %v", err)
+}
+
+// WithBucket makes Run use a bucket the caller has already opened, instead of
+// opening one from the bucket URL and AWS options. The caller remains
+// responsible for closing it.
+func WithBucket(bucket *blob.Bucket) func(*Mirror) {
+	return func(m *Mirror) {
+		m.bucket = bucket
 	}
-	if err = cmd.Start(); err != nil {
-		return nil, fmt.Errorf("start git: %v", err)
+}
+
+// WithContext sets the context for Run, Diff, Ping and RemovePreview to use
+// when they're passed a nil one, so that callers can configure a deadline
+// with the other options. A non-nil context passed to them is used instead.
+func WithContext(ctx context.Context) func(*Mirror) {
+	return func(m *Mirror) {
+		m.ctx = ctx
+	}
+}
+
+// runContext returns ctx, or if it's nil, the context set by WithContext, or
+// the background context if there isn't one.
+func (m *Mirror) runContext(ctx context.Context) context.Context {
+	if ctx != nil {
+		return ctx
 	}
+	if m.ctx != nil {
+		return m.ctx
+	}
+	return context.Background()
+}
 
-	return tar.NewReader(tarf), nil
+// Run uploads the site to the bucket. The Result is never nil; if Run fails,
+// it describes the work done before the failure. A file that fails to upload
+// doesn't stop the others, though nothing is pruned or promoted afterwards,
+// so that running again only has the failures to redo; see WithRetryPolicy
+// to retry them right away. ctx may be nil; see WithContext.
+func (m *Mirror) Run(ctx context.Context) (*Result, error) {
+	ctx = m.runContext(ctx)
+	start := m.clock.Now()
+	res := &Result{Ref: m.gitRef}
+	var err error
+	for _, before := range m.beforeRun {
+		if err = before(ctx); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = m.run(ctx, res)
+	}
+	err = classify(err)
+	res.Duration = m.clock.Now().Sub(start)
+	for _, after := range m.afterRun {
+		err = after(ctx, res, err)
+	}
+	return res, err
+}
+
+// logf logs a message about the Run's progress.
+func (m *Mirror) logf(format string, v ...interface{}) {
+	if m.logger != nil {
+		m.logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// validate returns an error if the options don't make sense together.
+func (m *Mirror) validate() error {
+	if err := checkGlobs(m.protectedKeys); err != nil {
+		return fmt.Errorf("protected keys: %w", err)
+	}
+	if err := checkGlobs(m.gzipExclude); err != nil {
+		return fmt.Errorf("gzip exclude: %w", err)
+	}
+	if m.streamThreshold < 0 {
+		return fmt.Errorf("stream threshold %d is negative", m.streamThreshold)
+	}
+	if m.streamThreshold > 0 && len(m.transforms) > 0 {
+		return errors.New("transforms need files in memory, so they can't be combined with a stream threshold")
+	}
+	if err := checkGlobs(m.fingerprint); err != nil {
+		return fmt.Errorf("fingerprint: %w", err)
+	}
+	if err := m.checkObjectRules(); err != nil {
+		return err
+	}
+	if err := m.filter.check(); err != nil {
+		return fmt.Errorf("file filter: %w", err)
+	}
+	switch m.planFormat {
+	case "", PlanText, PlanDiff:
+	default:
+		return fmt.Errorf(`unknown plan format "%s"`, m.planFormat)
+	}
+	switch m.archiveFormat {
+	case "", ArchiveTar, ArchiveTarGz, ArchiveZip:
+	default:
+		return fmt.Errorf(`unknown archive format "%s"`, m.archiveFormat)
+	}
+	if !m.managedAWSEnv && (m.awsProfile != "" || m.awsRegion != "") {
+		return errors.New("the AWS profile and region can't be set when the AWS environment isn't managed")
+	}
+	if m.onlyFiles != nil && m.prune {
+		return errors.New("pruning would delete every file not named by WithOnlyFiles")
+	}
+	if m.diffFrom != "" && m.prune {
+		return errors.New("pruning would delete every file that didn't change in the diff range")
+	}
+	switch m.compression {
+	case "", CompressionGzip, CompressionBrotli:
+	default:
+		return fmt.Errorf(`unknown compression "%s"`, m.compression)
+	}
+	if m.compression != "" && m.gzipSiblings {
+		return errors.New("gzip siblings of compressed files would be compressed twice")
+	}
+	if m.diffFrom != "" && m.submodules {
+		return errors.New("a diff range can't see changes within submodules")
+	}
+	if m.diffFrom != "" && m.onlyFiles != nil {
+		return errors.New("a diff range can't be combined with a list of files to upload")
+	}
+	if len(m.fingerprint) > 0 && m.deleteBeforeUpload {
+		return errors.New("fingerprinted names aren't known until the files are read, which is too late to delete before uploading")
+	}
+	if m.movesFiles && m.deleteBeforeUpload {
+		return errors.New("the keys rewrites move files to aren't known until the files are read, which is too late to delete before uploading")
+	}
+	if err := m.checkExtraFileNames(); err != nil {
+		return err
+	}
+	if err := m.checkDirectorySource(); err != nil {
+		return err
+	}
+	if err := m.checkWebsiteBucket(); err != nil {
+		return err
+	}
+	if err := m.checkAutoRegion(); err != nil {
+		return err
+	}
+	if m.retryPolicy.MaxAttempts < 0 || m.retryPolicy.InitialDelay < 0 || m.retryPolicy.MaxDelay < 0 {
+		return errors.New("retry policy has a negative attempt count or delay")
+	}
+	if m.lockTTL <= 0 {
+		return fmt.Errorf("lock TTL %v isn't positive", m.lockTTL)
+	}
+	if m.deleteThreshold < 0 || m.deleteThreshold > 100 {
+		return fmt.Errorf("delete threshold %g%% isn't between 0 and 100", m.deleteThreshold)
+	}
+	if m.listPageSize < 0 || m.listPageSize > maxListPageSize {
+		return fmt.Errorf("list page size %d isn't between 1 and %d", m.listPageSize, maxListPageSize)
+	}
+	if m.partSize != 0 && m.partSize < minPartSize {
+		return fmt.Errorf("part size %d is less than the minimum of %d", m.partSize, minPartSize)
+	}
+	if m.workTree != "" && m.gitDir == "" && m.siteSourcePath == "" {
+		return errors.New("a work tree needs a git dir or repo root to find the repository")
+	}
+	if m.directorySource == "" {
+		// A repository that isn't there isn't a git repository.
+		for _, dir := range []string{m.siteSourcePath, m.gitDir} {
+			if err := checkDir(dir); err != nil {
+				return fmt.Errorf("%w: %v", ErrNotGitRepo, err)
+			}
+		}
+	}
+	return checkDir(m.workTree)
+}
+
+// checkDir returns an error if dir is set but isn't a directory.
+func checkDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// delimiter returns the list delimiter set by WithListDelimiter or
+// WithShallow, or "" if Run should descend into every "subdirectory".
+func (m *Mirror) delimiter() string {
+	if m.listDelimiter == "" && m.shallow {
+		return "/"
+	}
+	return m.listDelimiter
+}
+
+// Close releases the resources the Mirror owns: the bucket opened by Run, but
+// not one provided with WithBucket. Run may be called again after Close.
+func (m *Mirror) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.ownsBucket {
+		return nil
+	}
+	bucket := m.bucket
+	m.bucket, m.ownsBucket = nil, false
+	return bucket.Close()
+}
+
+// Ping checks that the bucket can be opened and listed with the configured
+// options and credentials, without looking at the site or changing anything.
+func (m *Mirror) Ping(ctx context.Context) error {
+	ctx = m.runContext(ctx)
+	bucket, err := m.openBucket(ctx)
+	if err != nil {
+		return classify(fmt.Errorf("open bucket: %w", err))
+	}
+	// One object is enough to show that listing works.
+	if _, err := bucket.List(m.pagedListOptions(1)).Next(ctx); err != nil && err != io.EOF {
+		return classify(fmt.Errorf("list bucket: %w", err))
+	}
+	return nil
+}
+
+// awsSession returns an AWS session configured by the AWS options. Options
+// that aren't set are read from the environment and config files as usual,
+// but the environment is never changed, so Mirrors with different options
+// can run at once.
+func (m *Mirror) awsSession() (*session.Session, error) {
+	opts := session.Options{SharedConfigState: session.SharedConfigEnable}
+	if m.managedAWSEnv {
+		opts.Profile = m.awsProfile
+		if m.awsRegion != "" {
+			opts.Config.Region = aws.String(m.awsRegion)
+		}
+	}
+	return session.NewSessionWithOptions(opts)
+}
+
+// openBucketURL opens the bucket at rawurl. S3 buckets are opened with the
+// session from awsSession.
+func (m *Mirror) openBucketURL(ctx context.Context, rawurl string) (*blob.Bucket, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != s3blob.Scheme {
+		return blob.OpenBucket(ctx, rawurl)
+	}
+	sess, err := m.awsSession()
+	if err != nil {
+		return nil, err
+	}
+	opener := &s3blob.URLOpener{ConfigProvider: sess}
+	return opener.OpenBucketURL(ctx, u)
+}
+
+// openBucket returns the bucket to mirror to, opening it if necessary.
+func (m *Mirror) openBucket(ctx context.Context) (*blob.Bucket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.bucket != nil {
+		return m.bucket, nil
+	}
+	bucket, err := m.openBucketURL(ctx, m.bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	if m.autoRegion {
+		reopened, err := m.reopenInRegion(ctx, bucket)
+		if err != nil {
+			bucket.Close()
+			return nil, err
+		}
+		bucket = reopened
+	}
+	m.bucket, m.ownsBucket = bucket, true
+	return bucket, nil
+}
+
+func (m *Mirror) run(ctx context.Context, res *Result) (err error) {
+	r, err := m.newRun(ctx, res)
+	if err != nil {
+		return err
+	}
+	if m.diffFrom != "" {
+		if err := r.applyDiffRange(); err != nil {
+			return fmt.Errorf("diff range: %w", err)
+		}
+	}
+	if m.lock && !m.dryRun {
+		lock, lockErr := r.acquireLock(ctx)
+		if lockErr != nil {
+			return lockErr
+		}
+		defer func() {
+			if releaseErr := lock.release(context.Background()); releaseErr != nil && err == nil {
+				err = fmt.Errorf("release lock: %w", releaseErr)
+			}
+		}()
+	}
+
+	if err := r.mirror(ctx); err != nil {
+		return err
+	}
+	if m.distributionID != "" {
+		if err := r.invalidate(ctx); err != nil {
+			return fmt.Errorf("invalidate CloudFront distribution %s: %w", m.distributionID, err)
+		}
+	}
+	if m.planFormat != "" {
+		if err := r.writePlan(m.planOutput); err != nil {
+			return fmt.Errorf("write plan: %w", err)
+		}
+	}
+	return nil
+}
+
+// newRun checks the options, resolves the git ref, and opens the bucket,
+// recording the ref's SHA in res.
+func (m *Mirror) newRun(ctx context.Context, res *Result) (*mirrorRun, error) {
+	r, err := m.newLocalRun(res)
+	if err != nil {
+		return nil, err
+	}
+	if r.bucket, err = m.openBucket(ctx); err != nil {
+		return nil, fmt.Errorf("open bucket: %w", err)
+	}
+	return r, nil
+}
+
+// newLocalRun is like newRun, but doesn't open the bucket, for looking at the
+// site alone.
+func (m *Mirror) newLocalRun(res *Result) (*mirrorRun, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := m.loadMimeTypes(); err != nil {
+		return nil, err
+	}
+	if err := m.resolveBranchPrefix(); err != nil {
+		return nil, err
+	}
+
+	var treeish string
+	if m.directorySource != "" {
+		res.Ref = m.directorySource
+	} else {
+		var sha string
+		var err error
+		if treeish, sha, err = m.resolveRef(m.gitRef); err != nil {
+			return nil, err
+		}
+		res.CommitSHA = sha
+	}
+
+	return &mirrorRun{
+		Mirror:  m,
+		res:     res,
+		treeish: treeish,
+		only:    m.onlyFiles,
+		started: m.clock.Now(),
+	}, nil
+}
+
+// mirrorRun is the state of a single Run.
+type mirrorRun struct {
+	*Mirror
+	bucket *blob.Bucket
+	res    *Result
+	// treeish is what to archive: the resolved ref, so that every archive
+	// made during the Run has the same files.
+	treeish string
+
+	// started is when the Run started.
+	started time.Time
+	// only is the set of files to upload, or nil to upload them all.
+	only map[string]bool
+	// removed is the files the diff range removed, to delete from the bucket.
+	removed []string
+
+	// remote is the bucket's listing, by key. It's nil in low memory mode.
+	// fromManifest is whether it was read from the manifest instead, and
+	// checksums is the manifest entry of each file, for the next manifest.
+	remote       map[string]*object
+	fromManifest bool
+	checksums    map[string]manifestEntry
+	// gitignore is the site's .gitignore, if WithHonorGitignore is set.
+	gitignore gitignore
+	// site is the set of keys that are part of the site. While files are
+	// being synced, it's guarded by resMu.
+	site map[string]bool
+	// stagedFiles is the files uploaded to the staging prefix.
+	stagedFiles []stagedFile
+	// uploadedSums is what each uploaded object should have, if WithVerify
+	// is set.
+	uploadedSums map[string]uploadedSum
+
+	// resMu guards res, which may be updated from several goroutines at
+	// once.
+	resMu sync.Mutex
+	// uploads and uploadBytes count the files uploaded, or planned to be, so
+	// far.
+	uploads     int
+	uploadBytes int64
+}
+
+// mirror makes the bucket match the site.
+func (r *mirrorRun) mirror(ctx context.Context) error {
+	if r.requireEmpty {
+		if err := r.checkEmpty(ctx); err != nil {
+			return err
+		}
+	}
+	if r.manifestChecksums {
+		if err := r.readManifest(ctx); err != nil {
+			return err
+		}
+	}
+	if r.remote == nil && !r.lowMemory {
+		_, span := r.instrumentation.StartSpan(ctx, "list", r.keyPrefix)
+		err := r.listRemote(ctx)
+		span.End(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	plan, err := r.plan(r.treeish, r.only)
+	if err != nil {
+		return fmt.Errorf("plan: %w", err)
+	}
+	defer plan.spool.remove()
+	r.res.Ignored = plan.ignored
+	r.gitignore = plan.gitignore
+	if r.failOnEmpty && r.diffFrom == "" && len(plan.keys) == 0 {
+		return ErrEmptyArchive
+	}
+	if err := r.checkKeys(plan.keys); err != nil {
+		return err
+	}
+	if err := r.checkErrorDocument(plan); err != nil {
+		return err
+	}
+	if r.remote != nil && ((r.checksum == ChecksumSHA256 && !r.fromManifest) || r.reconcileTypes) {
+		r.prefetchAttributes(ctx, plan)
+	}
+
+	r.site = map[string]bool{}
+	if r.deleteBeforeUpload {
+		for _, key := range plan.keys {
+			r.site[key] = true
+		}
+		if err := r.deleteStale(ctx); err != nil {
+			return err
+		}
+	}
+
+	tarf, err := r.getSiteTar(r.treeish)
+	if err != nil {
+		return fmt.Errorf("get site tar: %w", err)
+	}
+	defer tarf.Close()
+
+	// Files are read and hashed by one goroutine while others upload them, so
+	// local I/O for the next file overlaps the network I/O for the current.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	files := make(chan *file, fileQueueSize)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(files)
+		ctx, span := r.instrumentation.StartSpan(ctx, "archive", r.treeish)
+		err := r.readFiles(ctx, tarf.Reader, plan, files)
+		span.End(err)
+		readErr <- err
+	}()
+
+	r.checksums = map[string]manifestEntry{}
+	// sent is the keys of the files read so far.
+	sent := map[string]bool{}
+	// Up to the concurrency limit of files are synced at once. The first
+	// error cancels the rest.
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxInt(r.concurrency, 1))
+	var errMu sync.Mutex
+	var firstErr, firstFileErr error
+	failedFiles, dispatched := 0, 0
+	fail := func(err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		} else if !errors.Is(err, context.Canceled) {
+			r.recordError(err)
+		}
+	}
+	// failFile records the failure of a request about a single file and
+	// keeps going, so that the next Run has only the failures to redo. Being
+	// refused access is likely to happen to every file, so it stops the Run.
+	failFile := func(err error) {
+		var uerr *UploadError
+		if !errors.As(err, &uerr) || isAccessDenied(err) || ctx.Err() != nil {
+			fail(err)
+			return
+		}
+		r.logf("warning: %v", err)
+		r.recordError(err)
+		errMu.Lock()
+		defer errMu.Unlock()
+		if failedFiles++; firstFileErr == nil {
+			firstFileErr = err
+		}
+	}
+files:
+	for f := range files {
+		duplicate, err := r.isDuplicate(sent, f)
+		if err != nil {
+			fail(err)
+			break
+		}
+		if duplicate {
+			continue
+		}
+		replacing := sent[f.key]
+		sent[f.key] = true
+		r.resMu.Lock()
+		r.site[f.key] = true
+		r.resMu.Unlock()
+		r.recordFingerprint(f)
+		if replacing {
+			// The earlier file must be uploaded first.
+			wg.Wait()
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break files
+		}
+		dispatched++
+		wg.Add(1)
+		go func(f *file) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := r.syncFile(ctx, plan, f, replacing); err != nil {
+				failFile(err)
+			}
+		}(f)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if failedFiles > 0 {
+		// Nothing is promoted or pruned until every file is up to date.
+		return fmt.Errorf("%d of %d files failed to sync, the first with: %w", failedFiles, dispatched, firstFileErr)
+	}
+
+	if err := <-readErr; err != nil {
+		return err
+	}
+	if err := tarf.finish(); err != nil {
+		return fmt.Errorf("get site tar: %w", err)
+	}
+
+	if r.configWebsite && r.errorDocument != "" {
+		if err := r.configureWebsite(ctx); err != nil {
+			return fmt.Errorf("configure website: %w", err)
+		}
+	}
+
+	if len(r.stagedFiles) > 0 {
+		if err := r.promote(ctx); err != nil {
+			return fmt.Errorf("promote staged files: %w", err)
+		}
+	}
+
+	if len(r.uploadedSums) > 0 {
+		if err := r.verifyUploads(ctx); err != nil {
+			return fmt.Errorf("verify: %w", err)
+		}
+	}
+
+	if !r.deleteBeforeUpload {
+		if err := r.deleteStale(ctx); err != nil {
+			return err
+		}
+	}
+
+	if r.manifestChecksums {
+		if err := r.writeManifest(ctx); err != nil {
+			return fmt.Errorf("write manifest: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// syncFile uploads f unless the bucket already has it. replacing is whether
+// an earlier file had the same key.
+func (r *mirrorRun) syncFile(ctx context.Context, plan *plan, f *file, replacing bool) error {
+	obj, err := r.lookup(ctx, f.key)
+	if err != nil {
+		return fmt.Errorf(`look up "%s": %w`, f.key, err)
+	}
+	var unchanged bool
+	switch {
+	case replacing:
+		// It's uploaded even if it matches the listing, which predates the
+		// upload of the earlier file.
+	case r.shouldUpload != nil:
+		var remoteMD5 []byte
+		if obj != nil {
+			remoteMD5 = obj.md5
+		}
+		unchanged = !r.shouldUpload(f.key, f.md5[:], remoteMD5, f.size)
+	default:
+		if unchanged, err = r.isUnchanged(ctx, obj, f); err != nil {
+			return fmt.Errorf(`compare file "%s": %w`, f.key, err)
+		}
+	}
+	retyped := false
+	if unchanged && r.reconcileTypes {
+		if retyped, err = r.isRetyped(ctx, obj, f); err != nil {
+			return fmt.Errorf(`compare content type of "%s": %w`, f.key, err)
+		}
+	}
+	if unchanged && !retyped {
+		r.logf("skipping %s…", f.key)
+		r.recordSkip(f)
+		r.recordChecksum(f, obj)
+		r.reportProgress(f.key, f.size, ChangeKeep)
+		return nil
+	}
+
+	if err := r.spendBudget(f, plan); err != nil {
+		return err
+	}
+	op := ChangeAdd
+	if obj != nil {
+		op = ChangeUpdate
+	}
+	r.recordChange(Change{Key: f.key, Op: op, Retyped: retyped})
+	if r.dryRun {
+		r.logf("would upload %s…", f.key)
+		r.reportProgress(f.key, f.size, op)
+		return nil
+	}
+	r.logf("uploading %s…", f.key)
+
+	options := &blob.WriterOptions{
+		ContentType:        f.contentType,
+		ContentEncoding:    f.contentEncoding,
+		ContentLanguage:    f.contentLanguage,
+		CacheControl:       f.cacheControl,
+		ContentDisposition: f.contentDisposition,
+	}
+	options.Metadata = r.objectMetadata(f)
+	options.BufferSize = r.bufferSize(f.size)
+	options.BeforeWrite = r.beforeWrite(f)
+	key := f.key
+	if r.isStaged(f) {
+		key = r.stagingKey(f.key)
+		r.resMu.Lock()
+		r.stagedFiles = append(r.stagedFiles, stagedFile{key: f.key, acl: f.acl, redirect: f.redirect})
+		r.resMu.Unlock()
+	}
+	start := r.clock.Now()
+	uploadCtx, span := r.instrumentation.StartSpan(ctx, "upload", f.key)
+	err = r.retry(uploadCtx, "upload", f.key, func() error {
+		r.countRequest(&r.res.Requests.Puts)
+		return r.write(uploadCtx, key, f, options)
+	})
+	span.End(err)
+	if err != nil {
+		return &UploadError{Op: "upload", Key: f.key, Err: err}
+	}
+	r.instrumentation.RecordUpload(f.key, f.size, r.clock.Now().Sub(start))
+	if err := r.recordUploadedSum(f); err != nil {
+		return &UploadError{Op: "upload", Key: f.key, Err: err}
+	}
+	r.recordUpload(f, retyped)
+	r.recordChecksum(f, obj)
+	r.reportProgress(f.key, f.size, op)
+	return nil
+}
+
+// deleteStale deletes the files the diff range removed and, if pruning, the
+// objects that aren't part of the site. r.site must be complete.
+func (r *mirrorRun) deleteStale(ctx context.Context) error {
+	if len(r.removed) > 0 {
+		if err := r.deleteRemoved(ctx); err != nil {
+			return fmt.Errorf("delete removed files: %w", err)
+		}
+	}
+
+	if r.prune {
+		if err := r.pruneObjects(ctx); err != nil {
+			return fmt.Errorf("prune: %w", err)
+		}
+	}
+	return nil
+}
+
+// objectMetadata returns the metadata to upload f with, or nil if it has none.
+func (m *Mirror) objectMetadata(f *file) map[string]string {
+	metadata := map[string]string{}
+	for k, v := range f.metadata {
+		metadata[k] = v
+	}
+	if f.sha256 != nil {
+		metadata[sha256MetadataKey] = hex.EncodeToString(f.sha256)
+	}
+	if m.varies(f) {
+		metadata[varyMetadataKey] = "Accept-Encoding"
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+// fileQueueSize is how many files may be read ahead of the upload in progress.
+const fileQueueSize = 4
+
+// file is an object to upload, usually a regular file read from the site tar.
+type file struct {
+	key string
+	// data is exactly what's uploaded, compressed or transformed if it's to
+	// be, and md5 and sha256 are computed from it, so that they can be
+	// compared with the checksums of the object in the bucket.
+	data []byte
+	// spooled holds the contents instead of data if they're streamed; see
+	// WithStreamThreshold.
+	spooled *spooledFile
+	size    int64
+	md5     [md5.Size]byte
+	// sha256 is only computed when the checksum algorithm or manifest needs
+	// it.
+	sha256          []byte
+	contentType     string
+	contentEncoding string
+	contentLanguage string
+	cacheControl    string
+	// contentDisposition and metadata come from the site config.
+	contentDisposition string
+	metadata           map[string]string
+	// redirect is the website redirect location to set on the object.
+	redirect string
+	// acl is the canned ACL to set on the object, if any.
+	acl string
+	// original is the file's name in the site if key has its fingerprint.
+	original string
+	// headers is the headers rewrites set, if there are transforms.
+	headers *blob.WriterOptions
+}
+
+// newFile returns a file with the given contents, computing the checksums
+// Run needs to compare it with the bucket.
+func (m *Mirror) newFile(key string, data []byte, contentType string) *file {
+	f := &file{
+		key:          key,
+		data:         data,
+		size:         int64(len(data)),
+		md5:          md5.Sum(data),
+		contentType:  contentType,
+		cacheControl: m.cacheControlFor(key),
+		acl:          m.aclFor(key),
+	}
+	if m.contentLanguage != nil {
+		f.contentLanguage = m.contentLanguage(key)
+	}
+	if m.needsSHA256() {
+		sum := sha256.Sum256(data)
+		f.sha256 = sum[:]
+	}
+	return f
+}
+
+// derivedFiles returns the files Run generates from f, a file from the site.
+// Generated files are part of the site like any other, so they're compared
+// with the bucket and kept from being pruned the same way.
+func (m *Mirror) derivedFiles(f *file) []*file {
+	var derived []*file
+	if index := m.directoryIndexFile(f); index != nil {
+		derived = append(derived, index)
+	}
+	if clean := m.cleanURLFile(f); clean != nil {
+		derived = append(derived, clean)
+	}
+	if gz, err := m.gzipSibling(f); err != nil {
+		m.logf("warning: not compressing %s: %v", f.key, err)
+	} else if gz != nil {
+		derived = append(derived, gz)
+	}
+	for _, d := range derived {
+		d.cacheControl, d.acl = f.cacheControl, f.acl
+		d.contentDisposition, d.metadata = f.contentDisposition, f.metadata
+	}
+	return derived
+}
+
+// derivedKeys returns the keys of the files derivedFiles generates for the
+// file at key, of the given content type, mapped to their sizes, or to -1 if
+// the size isn't known until the file has been read.
+func (m *Mirror) derivedKeys(key, contentType string, size int64) map[string]int64 {
+	derived := map[string]int64{}
+	if indexKey := m.directoryIndexKey(key); indexKey != "" {
+		if m.directoryIndex == DirectoryIndexRedirect {
+			size = 0
+		}
+		derived[indexKey] = size
+	}
+	if cleanKey := m.cleanURLKey(key); cleanKey != "" {
+		derived[cleanKey] = size
+	}
+	if gzKey := m.gzipSiblingKey(key, contentType); gzKey != "" {
+		derived[gzKey] = -1
+	}
+	return derived
+}
+
+// readFiles sends every file to upload from r to files, stopping early if ctx
+// is cancelled.
+func (m *Mirror) readFiles(ctx context.Context, r *tar.Reader, plan *plan, files chan<- *file) error {
+	// Hard links refer to files earlier in the tar, so the contents of the
+	// files they refer to are kept until the end.
+	linked := map[string][]byte{}
+	linkedSpooled := map[string]*spooledFile{}
+
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			if err := m.sendExtraFiles(ctx, plan, files); err != nil {
+				return err
+			}
+			return m.sendRedirects(ctx, plan, files)
+		}
+		if err != nil {
+			return fmt.Errorf("get next file in tar: %w", err)
+		}
+		m.normalizeHeader(header)
+
+		if !m.isUploadable(plan, header) {
+			m.logSkippedEntry(plan, header)
+			continue
+		}
+		included := plan.includes(header.Name)
+		if !included && !plan.linkTargets[header.Name] {
+			continue
+		}
+
+		var data []byte
+		var spooled *spooledFile
+		switch {
+		case header.Typeflag == tar.TypeLink:
+			var ok bool
+			if data, ok = linked[header.Linkname]; !ok {
+				if spooled, ok = linkedSpooled[header.Linkname]; !ok {
+					return fmt.Errorf(`hard link "%s" refers to unknown file "%s"`, header.Name, header.Linkname)
+				}
+			}
+		case m.streams(header):
+			if spooled, err = plan.spool.write(r, m.needsSHA256()); err != nil {
+				return fmt.Errorf(`spool file "%s": %w`, header.Name, err)
+			}
+			if plan.linkTargets[header.Name] {
+				linkedSpooled[header.Name] = spooled
+			}
+		default:
+			data, err = ioutil.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf(`read file "%s": %w`, header.Name, err)
+			}
+			if plan.linkTargets[header.Name] {
+				linked[header.Name] = data
+			}
+		}
+		if !included {
+			// It was only read for the hard links to it.
+			continue
+		}
+		if spooled != nil {
+			if err := m.sendSpooledFile(ctx, plan, header.Name, spooled, files); err != nil {
+				return err
+			}
+			continue
+		}
+		if m.skipEmptyFiles && len(data) == 0 {
+			m.logf("skipping %s, it's empty…", header.Name)
+			continue
+		}
+
+		if err := m.sendFile(ctx, plan, header.Name, data, files); err != nil {
+			return err
+		}
+	}
+}
+
+// sendFile sends the file at name, with the given contents, and the files
+// derived from it to files.
+func (m *Mirror) sendFile(ctx context.Context, plan *plan, name string, data []byte, files chan<- *file) error {
+	var contentType string
+	if !m.noContentType {
+		// Contents are sniffed before they're transformed or compressed.
+		if contentType = m.contentTypeFor(name); contentType == "" {
+			contentType = sniffContentType(data)
+		}
+	}
+	key := m.siteKey(name)
+	var headers *blob.WriterOptions
+	moved := false
+	if len(m.transforms) > 0 {
+		var newKey string
+		var err error
+		if data, newKey, headers, err = m.transform(key, data); err != nil {
+			return fmt.Errorf(`transform "%s": %w`, name, err)
+		}
+		key, moved = newKey, newKey != key
+	}
+	var contentEncoding string
+	if headers != nil {
+		contentEncoding = headers.ContentEncoding
+	}
+	if contentEncoding == "" {
+		// Compression depends on the content type the file will be uploaded
+		// with, which the site config and rules may set.
+		finalType := m.finalContentType(plan.config, name, contentType, headers)
+		var err error
+		if data, contentEncoding, err = m.compress(name, finalType, data); err != nil {
+			return fmt.Errorf(`compress "%s": %w`, name, err)
+		}
+	}
+	var original string
+	if fingerprinted := m.fingerprintName(name, md5.Sum(data)); fingerprinted != name && !moved {
+		key, original = m.siteKey(fingerprinted), name
+	}
+	f := m.newFile(key, data, contentType)
+	f.contentEncoding, f.original, f.headers = contentEncoding, original, headers
+	return m.sendWithDerived(ctx, plan, name, f, files)
+}
+
+// sendSpooledFile is like sendFile, for a file whose contents were spooled.
+// They're left as they are, without compression.
+func (m *Mirror) sendSpooledFile(ctx context.Context, plan *plan, name string, spooled *spooledFile, files chan<- *file) error {
+	var contentType string
+	if !m.noContentType {
+		if contentType = m.contentTypeFor(name); contentType == "" {
+			head, err := spooled.readAt(0, sniffLen)
+			if err != nil {
+				return fmt.Errorf(`read "%s": %w`, name, err)
+			}
+			contentType = sniffContentType(head)
+		}
+	}
+	key := m.siteKey(name)
+	var original string
+	if fingerprinted := m.fingerprintName(name, spooled.md5); fingerprinted != name {
+		key, original = m.siteKey(fingerprinted), name
+	}
+	f := m.newSpooledFile(key, spooled, contentType)
+	f.original = original
+	return m.sendWithDerived(ctx, plan, name, f, files)
+}
+
+// sendWithDerived applies the site's headers to f, the file at name, and
+// sends it and the files derived from it to files.
+func (m *Mirror) sendWithDerived(ctx context.Context, plan *plan, name string, f *file, files chan<- *file) error {
+	m.applyHeaders(plan.config, f, name)
+	for _, f := range append([]*file{f}, m.derivedFiles(f)...) {
+		if reason := m.excludedKey(f.key); reason != "" {
+			m.logf("skipping %s, %s…", f.key, reason)
+			continue
+		}
+		select {
+		case files <- f:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// applyHeaders sets the headers the site config, the rules, and any
+// transform give f, the file at name.
+func (m *Mirror) applyHeaders(config *siteConfig, f *file, name string) {
+	// The key may have lost the name's extension; see WithCleanURLs.
+	f.acl = m.aclFor(name)
+	m.applySiteConfig(config, f, name)
+	m.applyObjectRules(f, name)
+	if f.headers != nil {
+		m.applyRule(f, Rule{
+			CacheControl:       f.headers.CacheControl,
+			ContentType:        f.headers.ContentType,
+			ContentDisposition: f.headers.ContentDisposition,
+			ContentLanguage:    f.headers.ContentLanguage,
+			Metadata:           f.headers.Metadata,
+		})
+	}
+}
+
+// finalContentType returns the content type applyHeaders will give the file
+// at name, which was detected as contentType, and whose transform returned
+// headers.
+func (m *Mirror) finalContentType(config *siteConfig, name, contentType string, headers *blob.WriterOptions) string {
+	f := &file{contentType: contentType, headers: headers}
+	m.applyHeaders(config, f, name)
+	return f.contentType
+}
+
+// normalizeHeader cleans up the paths in header, unless WithNormalizePaths is
+// off. The tar is always read through here, so every key Run compares,
+// uploads, or keeps from pruning is normalized the same way.
+func (m *Mirror) normalizeHeader(header *tar.Header) {
+	if m.keepPaths {
+		return
+	}
+	header.Name = normalizePath(header.Name)
+	if header.Typeflag == tar.TypeLink {
+		header.Linkname = normalizePath(header.Linkname)
+	}
+}
+
+// normalizePath makes name a clean, slash-separated relative path.
+func normalizePath(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	trailing := strings.HasSuffix(name, "/")
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	if trailing && name != "" {
+		name += "/"
+	}
+	return name
+}
+
+// isUploadable reports whether the tar entry is a file Run should upload.
+func (m *Mirror) isUploadable(p *plan, header *tar.Header) bool {
+	switch header.Typeflag {
+	case tar.TypeReg:
+	case tar.TypeLink:
+		if !m.followHardlinks {
+			return false
+		}
+	default:
+		return false
+	}
+	return p.ignoreRule(header.Name) == ""
+}
+
+// ignoreRule returns the rule that keeps the file at name from being
+// uploaded, or "" if there isn't one.
+func ignoreRule(name string) string {
+	if _, ok := IgnoredFiles[name]; ok {
+		return name
+	}
+	if name == SiteConfigFile {
+		return SiteConfigFile
+	}
+	return ""
+}
+
+// internalDir holds the objects Run keeps for itself, under the key prefix.
+const internalDir = ".mirror2s3/"
+
+// excludedKey returns why Run mustn't write to key, or "" if it may.
+func (m *Mirror) excludedKey(key string) string {
+	if strings.HasPrefix(key, m.keyPrefix+internalDir) {
+		return "its name is reserved for mirror2s3"
+	}
+	if pattern := firstMatch(m.protectedKeys, key); pattern != "" {
+		return fmt.Sprintf(`it matches protected pattern "%s"`, pattern)
+	}
+	if d := m.delimiter(); d != "" && strings.Contains(strings.TrimPrefix(key, m.keyPrefix), d) {
+		return fmt.Sprintf(`it's nested below the list delimiter "%s"`, d)
+	}
+	return ""
+}
+
+// logSkippedEntry explains why a tar entry wasn't uploaded.
+func (m *Mirror) logSkippedEntry(p *plan, header *tar.Header) {
+	switch header.Typeflag {
+	case tar.TypeReg:
+		if rule := p.ignoreRule(header.Name); rule != "" {
+			m.logf(`skipping %s, it matches ignore rule "%s"…`, header.Name, rule)
+		}
+	case tar.TypeDir, tar.TypeXGlobalHeader:
+		// Nothing surprising.
+	case tar.TypeLink:
+		m.logf("skipping %s, it's a hard link (see WithFollowHardlinks)…", header.Name)
+	case tar.TypeSymlink:
+		m.logf("skipping %s, it's a symbolic link…", header.Name)
+	default:
+		m.logf("skipping %s, tar entries of type %q aren't supported…", header.Name, header.Typeflag)
+	}
+}
+
+// plan is what Run learns about the site from a first pass over the tar
+// headers, before reading any file contents.
+type plan struct {
+	// keys is the key of every file Run will upload.
+	keys []string
+	// sizes is the size of each file Run will upload, by key.
+	sizes map[string]int64
+	// linkTargets is the set of files that hard links refer to.
+	linkTargets map[string]bool
+	// ignored is the files that matched an ignore rule, in tar order.
+	ignored []IgnoredFile
+	// started is when the Run started.
+	started time.Time
+	// only is the set of files to upload, or nil to upload them all.
+	only map[string]bool
+	// config is the site config, or nil if the site doesn't have one.
+	config *siteConfig
+	// gitignore is the site's .gitignore, if WithHonorGitignore is set.
+	gitignore gitignore
+	// filter is the patterns set by WithExclude and WithInclude.
+	filter fileFilter
+	// spool holds the files that are streamed; see WithStreamThreshold.
+	spool spool
+	// redirects is the redirects in the site's redirects file, if
+	// WithRedirectsFile is set.
+	redirects []siteRedirect
+	// redirectsFile is its name, so it's ignored.
+	redirectsFile string
+}
+
+// ignoreRule is like the function ignoreRule, but also checks the
+// .gitignore and the patterns set by WithExclude and WithInclude.
+func (p *plan) ignoreRule(name string) string {
+	if rule := ignoreRule(name); rule != "" {
+		return rule
+	}
+	if name == p.redirectsFile {
+		return name
+	}
+	if rule := p.gitignore.match(name); rule != "" {
+		return rule
+	}
+	return p.filter.rule(name)
+}
+
+// addKey adds the file at name, uploaded at key, of the given size, and the
+// files derived from it to the plan, unless Run mustn't write to them. The
+// files' contents aren't known yet, so their content types are guessed from
+// their names, as set by the site config and rules.
+func (p *plan) addKey(m *Mirror, name, key string, size int64) {
+	if m.excludedKey(key) == "" {
+		p.keys = append(p.keys, key)
+		p.sizes[key] = size
+	}
+	contentType := m.finalContentType(p.config, name, m.contentTypeFor(name), nil)
+	for derivedKey, derivedSize := range m.derivedKeys(key, contentType, size) {
+		if m.excludedKey(derivedKey) == "" {
+			p.keys = append(p.keys, derivedKey)
+			p.sizes[derivedKey] = derivedSize
+		}
+	}
+}
+
+// includes reports whether the file at name is to be uploaded, if it's
+// uploadable.
+func (p *plan) includes(name string) bool {
+	return p.only == nil || p.only[name]
+}
+
+// plan reads the headers of the tar of treeish to see what Run will upload.
+// If only isn't nil, only the files named in it are uploaded.
+func (m *Mirror) plan(treeish string, only map[string]bool) (*plan, error) {
+	r, err := m.getSiteTar(treeish)
+	if err != nil {
+		return nil, fmt.Errorf("get site tar: %w", err)
+	}
+	defer r.Close()
+
+	config, err := m.readSiteConfig(treeish)
+	if err != nil {
+		return nil, fmt.Errorf("read site config: %w", err)
+	}
+	p := &plan{sizes: map[string]int64{}, linkTargets: map[string]bool{}, only: only, config: config, filter: m.filter}
+	if p.redirects, err = m.readRedirects(treeish); err != nil {
+		return nil, fmt.Errorf("read redirects: %w", err)
+	}
+	p.redirectsFile = m.redirectsFile
+	if m.honorGitignore {
+		if p.gitignore, err = m.readGitignore(treeish); err != nil {
+			return nil, fmt.Errorf("read .gitignore: %w", err)
+		}
+	}
+	found := map[string]bool{}
+	// fileSizes is the size of every uploadable file, including those not in
+	// only that hard links might refer to.
+	fileSizes := map[string]int64{}
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get next file in tar: %w", err)
+		}
+		m.normalizeHeader(header)
+		found[header.Name] = true
+		if !m.isUploadable(p, header) {
+			if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeLink && m.followHardlinks {
+				if rule := p.ignoreRule(header.Name); rule != "" {
+					p.ignored = append(p.ignored, IgnoredFile{Name: header.Name, Rule: rule})
+				}
+			}
+			continue
+		}
+		if _, ok := m.extraFiles[header.Name]; ok {
+			return nil, fmt.Errorf(`extra file "%s" is also in the site`, header.Name)
+		}
+		key, size := m.siteKey(header.Name), header.Size
+		if header.Typeflag == tar.TypeLink {
+			size = fileSizes[header.Linkname]
+		}
+		fileSizes[header.Name] = size
+		if !p.includes(header.Name) {
+			continue
+		}
+		if err := checkSize(key, size); err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeLink {
+			p.linkTargets[header.Linkname] = true
+		}
+		if m.skipEmptyFiles && size == 0 {
+			continue
+		}
+		if m.rewritesFiles() {
+			// Transforms and compression may change the size.
+			size = -1
+		}
+		p.addKey(m, header.Name, key, size)
+	}
+	if err := r.finish(); err != nil {
+		return nil, fmt.Errorf("get site tar: %w", err)
+	}
+	if err := m.planExtraFiles(p); err != nil {
+		return nil, err
+	}
+	if err := m.planRedirects(p); err != nil {
+		return nil, err
+	}
+	for name := range only {
+		if !found[name] {
+			m.logf("warning: %s isn't in the site", name)
+		}
+	}
+	return p, nil
+}
+
+// gitLog logs what git writes to its standard error.
+type gitLog struct {
+	m *Mirror
+}
+
+func (g gitLog) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		g.m.logf("git: %s", line)
+	}
+	return len(p), nil
+}
+
+// gitCommand returns a command running git with args against the site's
+// repository.
+func (m *Mirror) gitCommand(args ...string) *exec.Cmd {
+	gitArgs := []string{m.gitPath}
+	if m.gitDir != "" {
+		gitArgs = append(gitArgs, "--git-dir="+m.gitDir)
+	}
+	if m.workTree != "" {
+		gitArgs = append(gitArgs, "--work-tree="+m.workTree)
+	}
+	return &exec.Cmd{
+		Path:   m.gitPath,
+		Args:   append(gitArgs, args...),
+		Env:    []string{},
+		Dir:    m.siteSourcePath,
+		Stderr: gitLog{m},
+	}
+}
+
+// resolveRef checks that ref names something git can archive: a commit, a
+// tree, or a path within either, like "HEAD:website". It returns an
+// equivalent tree-ish that won't change if the ref moves, and the SHA of the
+// commit ref refers to ("" if it's a bare tree).
+func (m *Mirror) resolveRef(ref string) (treeish, commit string, err error) {
+	obj, err := m.gitOutput("rev-parse", "--verify", "--quiet", ref)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if bytes.Contains(exitErr.Stderr, []byte("not a git repository")) {
+			dir := m.gitDir
+			if dir == "" {
+				dir = m.siteSourcePath
+			}
+			return "", "", fmt.Errorf("%s: %w", dir, ErrNotGitRepo)
+		}
+		return "", "", fmt.Errorf(`git ref "%s" doesn't exist in the repository`, ref)
+	} else if err != nil {
+		return "", "", fmt.Errorf(`resolve git ref "%s": %w`, ref, err)
+	}
+	objType, err := m.gitOutput("cat-file", "-t", obj)
+	if err != nil {
+		return "", "", fmt.Errorf(`resolve git ref "%s": %w`, ref, err)
+	}
+	switch objType {
+	case "commit", "tag":
+		commit, err = m.gitOutput("rev-parse", "--verify", "--quiet", obj+"^{commit}")
+		if err != nil {
+			return "", "", fmt.Errorf(`resolve git ref "%s": %w`, ref, err)
+		}
+		return commit, commit, nil
+	case "tree":
+		// Archive the tree itself, but report the commit it's in if there is
+		// one (for refs like "HEAD:website").
+		if i := strings.Index(ref, ":"); i >= 0 {
+			commit, _ = m.gitOutput("rev-parse", "--verify", "--quiet", ref[:i]+"^{commit}")
+		}
+		return obj, commit, nil
+	default:
+		return "", "", fmt.Errorf(`git ref "%s" names a %s, not a commit or tree`, ref, objType)
+	}
+}
+
+// gitOutput runs git with args and returns its standard output, trimmed.
+func (m *Mirror) gitOutput(args ...string) (string, error) {
+	cmd := m.gitCommand(args...)
+	cmd.Stderr = nil
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// siteTar is the output of a running git archive, or of a walk of the
+// directory set by WithDirectorySource.
+type siteTar struct {
+	*tar.Reader
+	stdout io.ReadCloser
+	// archive is what the tar is read from: stdout, or a reader that decodes
+	// it.
+	archive io.Reader
+	// cmd is git, or nil for a directory.
+	cmd    *exec.Cmd
+	closed bool
+	err    error
+}
+
+// Close stops reading the archive and waits for git to exit. It returns an
+// error if git failed, which is only meaningful after reading the whole tar.
+func (t *siteTar) Close() error {
+	if !t.closed {
+		t.closed = true
+		if c, ok := t.archive.(io.Closer); ok && t.archive != t.stdout {
+			c.Close()
+		}
+		t.stdout.Close()
+		if t.cmd != nil {
+			t.err = t.cmd.Wait()
+		}
+	}
+	return t.err
+}
+
+// finish reads the rest of the archive, which may go on past the end of the
+// tar, then closes it. Closing it early can kill git with SIGPIPE, so this is
+// how to close a tar that's been read to the end.
+func (t *siteTar) finish() error {
+	_, err := io.Copy(ioutil.Discard, t.archive)
+	if closeErr := t.Close(); closeErr != nil {
+		return closeErr
+	}
+	return err
+}
+
+func (m *Mirror) getSiteTar(treeish string) (*siteTar, error) {
+	if m.directorySource != "" {
+		return m.directoryTar(), nil
+	}
+	format := m.archiveFormat
+	if format == "" {
+		format = ArchiveTar
+	}
+	cmd := m.gitCommand("archive", "--format="+string(format), treeish)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("get git stdout: %w", err)
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start git: %w", err)
+	}
+
+	t := &siteTar{stdout: stdout, cmd: cmd}
+	tarf, err := m.archiveReader(stdout)
+	if err != nil {
+		if waitErr := t.Close(); waitErr != nil {
+			// git's failure is likely why the archive couldn't be read.
+			return nil, fmt.Errorf("git archive: %w", waitErr)
+		}
+		return nil, err
+	}
+	t.Reader, t.archive = tar.NewReader(tarf), tarf
+	if m.submodules {
+		return m.addSubmodules(t, treeish)
+	}
+	return t, nil
 }
@@ -0,0 +1,612 @@
+package mirror2s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/fileblob"
+	"gocloud.dev/blob/memblob"
+)
+
+// testRepo is a git repository in a temporary directory, for Run to mirror.
+type testRepo struct {
+	t   testing.TB
+	dir string
+}
+
+// newTestRepo creates a repository with files, which map names to contents,
+// and commits them. The caller must call remove when done with it.
+func newTestRepo(t testing.TB, files map[string]string) *testRepo {
+	t.Helper()
+	if _, err := os.Stat("/usr/bin/git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir, err := ioutil.TempDir("", "mirror2s3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRepo{t: t, dir: dir}
+	r.git("init", "-q")
+	r.commit(files)
+	return r
+}
+
+// git runs git in the repository and returns its output, failing the test if
+// it fails.
+func (r *testRepo) git(args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command("/usr/bin/git", args...)
+	cmd.Dir = r.dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes files, deleting those whose contents are "", and commits.
+func (r *testRepo) commit(files map[string]string) {
+	r.t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(r.dir, filepath.FromSlash(name))
+		if contents == "" {
+			if err := os.Remove(path); err != nil {
+				r.t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	r.git("add", "-A")
+	r.git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "test")
+}
+
+func (r *testRepo) remove() {
+	os.RemoveAll(r.dir)
+}
+
+// mirror returns a Mirror of the repository into bucket.
+func (r *testRepo) mirror(bucket *blob.Bucket, options ...func(*Mirror)) *Mirror {
+	return New(append([]func(*Mirror){
+		WithGitRepoRoot(r.dir),
+		WithBucket(bucket),
+		WithLogOutput(ioutil.Discard),
+	}, options...)...)
+}
+
+// run runs a Mirror of the repository into bucket, failing the test if Run
+// fails.
+func (r *testRepo) run(bucket *blob.Bucket, options ...func(*Mirror)) *Result {
+	r.t.Helper()
+	m := r.mirror(bucket, options...)
+	defer m.Close()
+	res, err := m.Run(context.Background())
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return res
+}
+
+// bucketContents returns every object in bucket, mapping keys to contents.
+func bucketContents(t testing.TB, bucket *blob.Bucket) map[string]string {
+	t.Helper()
+	ctx := context.Background()
+	contents := map[string]string{}
+	itr := bucket.List(nil)
+	for {
+		obj, err := itr.Next(ctx)
+		if err == io.EOF {
+			return contents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := bucket.ReadAll(ctx, obj.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[obj.Key] = string(data)
+	}
+}
+
+// sorted returns a sorted copy of keys.
+func sorted(keys []string) []string {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	return keys
+}
+
+// keysOf returns the keys of m, in no particular order.
+func keysOf(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// testBucket is a kind of bucket for tests to mirror into.
+type testBucket struct {
+	name string
+	// open returns an empty bucket and a function that deletes it.
+	open func(t *testing.T) (*blob.Bucket, func())
+	// options are needed to mirror into the bucket.
+	options []func(*Mirror)
+}
+
+var testBuckets = []testBucket{
+	{
+		name: "memblob",
+		open: func(t *testing.T) (*blob.Bucket, func()) {
+			return memblob.OpenBucket(nil), func() {}
+		},
+	},
+	{
+		name: "fileblob",
+		open: func(t *testing.T) (*blob.Bucket, func()) {
+			dir, err := ioutil.TempDir("", "mirror2s3-bucket")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bucket, err := fileblob.OpenBucket(dir, nil)
+			if err != nil {
+				os.RemoveAll(dir)
+				t.Fatal(err)
+			}
+			return bucket, func() {
+				bucket.Close()
+				os.RemoveAll(dir)
+			}
+		},
+		// This version of fileblob lists no MD5s, so compare the checksums
+		// kept in metadata instead.
+		options: []func(*Mirror){WithChecksumAlgorithm(ChecksumSHA256)},
+	},
+}
+
+var testSite = map[string]string{
+	"index.html":      "<h1>Home</h1>",
+	"about.html":      "<h1>About</h1>",
+	"css/site.css":    "body { margin: 0 }",
+	"js/site.js":      "console.log('hi')",
+	"img/favicon.ico": "\x00\x00\x01\x00",
+}
+
+func TestRun(t *testing.T) {
+	for _, tb := range testBuckets {
+		t.Run(tb.name, func(t *testing.T) {
+			repo := newTestRepo(t, testSite)
+			defer repo.remove()
+			bucket, closeBucket := tb.open(t)
+			defer closeBucket()
+			options := append([]func(*Mirror){WithPrune(true)}, tb.options...)
+
+			res := repo.run(bucket, options...)
+			keys := sorted(keysOf(testSite))
+			if got := sorted(res.Uploaded); !reflect.DeepEqual(got, keys) {
+				t.Errorf("first run uploaded %q, want %q", got, keys)
+			}
+			if got := bucketContents(t, bucket); !reflect.DeepEqual(got, testSite) {
+				t.Errorf("after first run, bucket has %q, want %q", got, testSite)
+			}
+
+			res = repo.run(bucket, options...)
+			if len(res.Uploaded) != 0 {
+				t.Errorf("second run uploaded %q, want nothing", res.Uploaded)
+			}
+			if got := sorted(res.Skipped); !reflect.DeepEqual(got, keys) {
+				t.Errorf("second run skipped %q, want %q", got, keys)
+			}
+
+			repo.commit(map[string]string{"about.html": "", "index.html": "<h1>New home</h1>"})
+			res = repo.run(bucket, append(options, WithDryRun(true))...)
+			if len(res.Uploaded) != 0 || len(res.Deleted) != 0 {
+				t.Errorf("dry run uploaded %q and deleted %q, want nothing", res.Uploaded, res.Deleted)
+			}
+			wantChanges := map[string]ChangeOp{"about.html": ChangeDelete, "index.html": ChangeUpdate}
+			gotChanges := map[string]ChangeOp{}
+			for _, c := range res.Changes {
+				if c.Op != ChangeKeep {
+					gotChanges[c.Key] = c.Op
+				}
+			}
+			if !reflect.DeepEqual(gotChanges, wantChanges) {
+				t.Errorf("dry run planned %v, want %v", gotChanges, wantChanges)
+			}
+			if got := bucketContents(t, bucket); !reflect.DeepEqual(got, testSite) {
+				t.Errorf("after dry run, bucket has %q, want %q", got, testSite)
+			}
+
+			res = repo.run(bucket, options...)
+			if want := []string{"index.html"}; !reflect.DeepEqual(res.Uploaded, want) {
+				t.Errorf("pruning run uploaded %q, want %q", res.Uploaded, want)
+			}
+			if want := []string{"about.html"}; !reflect.DeepEqual(res.Deleted, want) {
+				t.Errorf("pruning run deleted %q, want %q", res.Deleted, want)
+			}
+			want := map[string]string{}
+			for name, contents := range testSite {
+				want[name] = contents
+			}
+			delete(want, "about.html")
+			want["index.html"] = "<h1>New home</h1>"
+			if got := bucketContents(t, bucket); !reflect.DeepEqual(got, want) {
+				t.Errorf("after pruning run, bucket has %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRunSkipsUnchangedCompressedFiles(t *testing.T) {
+	page := strings.Repeat("<p>Compressible, compressible, compressible.</p>\n", 100)
+	site := map[string]string{
+		"index.html":   page,
+		"css/site.css": strings.Repeat("p { margin: 0 }\n", 100),
+		"img/logo.png": "\x89PNG\r\n\x1a\n",
+	}
+	tests := []struct {
+		name    string
+		options []func(*Mirror)
+		// compressedKey is the key of index.html compressed.
+		compressedKey string
+	}{
+		{"gzip siblings", []func(*Mirror){WithGzipSiblings(true)}, "index.html.gz"},
+		{"gzip", []func(*Mirror){WithCompression(CompressionGzip, 0)}, "index.html"},
+		{"brotli", []func(*Mirror){WithCompression(CompressionBrotli, 0)}, "index.html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepo(t, site)
+			defer repo.remove()
+			bucket := memblob.OpenBucket(nil)
+			defer bucket.Close()
+
+			res := repo.run(bucket, tt.options...)
+			keys := sorted(res.Uploaded)
+			if len(keys) < len(site) {
+				t.Fatalf("first run uploaded %q, want at least %d objects", keys, len(site))
+			}
+			if got, ok := bucketContents(t, bucket)[tt.compressedKey]; !ok || got == page {
+				t.Errorf("%s isn't index.html compressed", tt.compressedKey)
+			}
+
+			res = repo.run(bucket, tt.options...)
+			if len(res.Uploaded) != 0 {
+				t.Errorf("second run uploaded %q, want nothing", res.Uploaded)
+			}
+			if got := sorted(res.Skipped); !reflect.DeepEqual(got, keys) {
+				t.Errorf("second run skipped %q, want %q", got, keys)
+			}
+		})
+	}
+}
+
+func TestRunCompressesByContentType(t *testing.T) {
+	// The rule gives the extensionless file its content type.
+	posts := strings.Repeat(`{"title": "Post"},`, 100)
+	repo := newTestRepo(t, map[string]string{"api/posts": posts})
+	defer repo.remove()
+	rule := WithObjectRules(Rule{Glob: "api/*", ContentType: "application/json"})
+	tests := []struct {
+		name    string
+		options []func(*Mirror)
+		// compressedKey is the key of the file compressed.
+		compressedKey string
+	}{
+		{"gzip siblings", []func(*Mirror){rule, WithGzipSiblings(true)}, "api/posts.gz"},
+		{"gzip", []func(*Mirror){rule, WithCompression(CompressionGzip, 0)}, "api/posts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := memblob.OpenBucket(nil)
+			defer bucket.Close()
+			repo.run(bucket, tt.options...)
+			attrs, err := bucket.Attributes(context.Background(), tt.compressedKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attrs.ContentEncoding != "gzip" || attrs.ContentType != "application/json" {
+				t.Errorf("%s has content type %q and encoding %q, want application/json and gzip", tt.compressedKey, attrs.ContentType, attrs.ContentEncoding)
+			}
+		})
+	}
+}
+
+// TestRunConcurrently checks Result's totals when many uploads and deletes
+// finish at once. Run it with -race.
+func TestRunConcurrently(t *testing.T) {
+	const n = 200
+	site := map[string]string{}
+	var size int64
+	for i := 0; i < n; i++ {
+		contents := strings.Repeat("x", i+1)
+		site[fmt.Sprintf("page%03d.html", i)] = contents
+		size += int64(len(contents))
+	}
+	repo := newTestRepo(t, site)
+	defer repo.remove()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	options := []func(*Mirror){WithConcurrency(8), WithPrune(true)}
+
+	res := repo.run(bucket, options...)
+	if len(res.Uploaded) != n {
+		t.Errorf("uploaded %d objects, want %d", len(res.Uploaded), n)
+	}
+	if res.UploadedBytes != size {
+		t.Errorf("uploaded %d bytes, want %d", res.UploadedBytes, size)
+	}
+	if len(res.Changes) != n {
+		t.Errorf("recorded %d changes, want %d", len(res.Changes), n)
+	}
+	if res.Requests.Puts != n {
+		t.Errorf("made %d PUTs, want %d", res.Requests.Puts, n)
+	}
+	if got := len(bucketContents(t, bucket)); got != n {
+		t.Errorf("bucket has %d objects, want %d", got, n)
+	}
+
+	// Delete half the pages and change the rest.
+	changes := map[string]string{}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("page%03d.html", i)
+		if i%2 == 0 {
+			changes[name] = ""
+		} else {
+			changes[name] = site[name] + "!"
+		}
+	}
+	repo.commit(changes)
+	res = repo.run(bucket, options...)
+	if len(res.Uploaded) != n/2 {
+		t.Errorf("second run uploaded %d objects, want %d", len(res.Uploaded), n/2)
+	}
+	if len(res.Deleted) != n/2 {
+		t.Errorf("second run deleted %d objects, want %d", len(res.Deleted), n/2)
+	}
+	if len(res.Changes) != n {
+		t.Errorf("second run recorded %d changes, want %d", len(res.Changes), n)
+	}
+	if got := len(bucketContents(t, bucket)); got != n/2 {
+		t.Errorf("after second run, bucket has %d objects, want %d", got, n/2)
+	}
+}
+
+func TestRunDuplicateKeys(t *testing.T) {
+	// With clean URLs, both files are copied to the key "about". Git lists
+	// about.html first.
+	site := map[string]string{
+		"about.html":       "<h1>About page</h1>",
+		"about/index.html": "<h1>About index</h1>",
+	}
+	tests := []struct {
+		name string
+		mode DuplicateKeyMode
+		// want is the contents of "about", or "" if Run should fail.
+		want string
+	}{
+		{"last wins", DuplicateKeyLastWins, site["about/index.html"]},
+		{"first wins", DuplicateKeyFirstWins, site["about.html"]},
+		{"error", DuplicateKeyError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepo(t, site)
+			defer repo.remove()
+			bucket := memblob.OpenBucket(nil)
+			defer bucket.Close()
+
+			m := repo.mirror(bucket, WithCleanURLs(CleanURLsCopy), WithDuplicateKeyMode(tt.mode))
+			defer m.Close()
+			_, err := m.Run(context.Background())
+			contents := bucketContents(t, bucket)
+			if tt.want == "" {
+				if err == nil {
+					t.Error("Run succeeded, want an error")
+				}
+				if len(contents) != 0 {
+					t.Errorf("failed Run wrote %q, want nothing", sorted(keysOf(contents)))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := contents["about"]; got != tt.want {
+				t.Errorf(`"about" is %q, want %q`, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCountsRequests(t *testing.T) {
+	repo := newTestRepo(t, testSite)
+	defer repo.remove()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	n := len(testSite)
+
+	// memblob doesn't report pages of listings, so Lists stays 0.
+	steps := []struct {
+		name    string
+		commit  map[string]string
+		options []func(*Mirror)
+		want    RequestCounts
+	}{
+		{name: "first run", want: RequestCounts{Puts: n}},
+		{name: "unchanged", want: RequestCounts{}},
+		{
+			// The objects have no SHA-256 metadata yet, so each is read and
+			// uploaded again.
+			name:    "SHA-256",
+			options: []func(*Mirror){WithChecksumAlgorithm(ChecksumSHA256)},
+			want:    RequestCounts{Puts: n, Gets: n},
+		},
+		{
+			name:   "prune",
+			commit: map[string]string{"about.html": "", "index.html": "<h1>New home</h1>"},
+			want:   RequestCounts{Puts: 1, Deletes: 1},
+		},
+	}
+	for _, step := range steps {
+		if step.commit != nil {
+			repo.commit(step.commit)
+		}
+		res := repo.run(bucket, append([]func(*Mirror){WithPrune(true)}, step.options...)...)
+		if res.Requests != step.want {
+			t.Errorf("%s: made requests %+v, want %+v", step.name, res.Requests, step.want)
+		}
+	}
+}
+
+func TestRunDirectoryIndexUnderPrefix(t *testing.T) {
+	repo := newTestRepo(t, map[string]string{
+		"index.html":      "<h1>Home</h1>",
+		"blog/index.html": "<h1>Blog</h1>",
+	})
+	defer repo.remove()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	repo.run(bucket, WithKeyPrefix("preview"), WithDirectoryIndex(DirectoryIndexCopy))
+	want := []string{"preview/blog/", "preview/blog/index.html", "preview/index.html"}
+	if got := sorted(keysOf(bucketContents(t, bucket))); !reflect.DeepEqual(got, want) {
+		t.Errorf("bucket has %q, want %q", got, want)
+	}
+}
+
+func TestRunDiffRangeInDirectory(t *testing.T) {
+	repo := newTestRepo(t, map[string]string{
+		"README.md":          "# Site",
+		"website/index.html": "<h1>Home</h1>",
+		"website/about.html": "<h1>About</h1>",
+	})
+	defer repo.remove()
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	repo.run(bucket, WithGitRef("HEAD:website"))
+	from := repo.git("rev-parse", "HEAD")
+
+	repo.commit(map[string]string{
+		"README.md":          "# The site",
+		"website/index.html": "<h1>New home</h1>",
+		"website/about.html": "",
+	})
+	res := repo.run(bucket, WithDiffRange(from, "HEAD:website"))
+	if want := []string{"index.html"}; !reflect.DeepEqual(res.Uploaded, want) {
+		t.Errorf("uploaded %q, want %q", res.Uploaded, want)
+	}
+	if want := []string{"about.html"}; !reflect.DeepEqual(res.Deleted, want) {
+		t.Errorf("deleted %q, want %q", res.Deleted, want)
+	}
+	want := map[string]string{"index.html": "<h1>New home</h1>"}
+	if got := bucketContents(t, bucket); !reflect.DeepEqual(got, want) {
+		t.Errorf("bucket has %q, want %q", got, want)
+	}
+}
+
+func TestRunNotGitRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror2s3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	for _, options := range [][]func(*Mirror){
+		{WithGitRepoRoot(dir)},
+		{WithGitRepoRoot(filepath.Join(dir, "missing"))},
+		{WithGitDir(filepath.Join(dir, "missing"))},
+	} {
+		m := New(append(options, WithBucket(bucket), WithLogOutput(ioutil.Discard))...)
+		if _, err := m.Run(context.Background()); !errors.Is(err, ErrNotGitRepo) {
+			t.Errorf("Run returned %v, want ErrNotGitRepo", err)
+		}
+	}
+}
+
+// TestRunLeavesNoGoroutines checks that Runs, failed or not, wait for
+// everything they start, and that Close releases the bucket Run opened.
+func TestRunLeavesNoGoroutines(t *testing.T) {
+	repo := newTestRepo(t, testSite)
+	defer repo.remove()
+	runs := []struct {
+		options []func(*Mirror)
+		wantErr bool
+	}{
+		{options: []func(*Mirror){WithConcurrency(4)}},
+		{options: []func(*Mirror){WithGitRef("no-such-ref")}, wantErr: true},
+		// The zip is converted to a tar by another goroutine, which Run
+		// stops reading from when it has uploaded too much.
+		{options: []func(*Mirror){WithArchiveFormat(ArchiveZip), WithMaxUploads(1)}, wantErr: true},
+	}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		for _, run := range runs {
+			m := New(append([]func(*Mirror){
+				WithGitRepoRoot(repo.dir),
+				WithBucketURL("mem://"),
+				WithLogOutput(ioutil.Discard),
+			}, run.options...)...)
+			if _, err := m.Run(context.Background()); (err != nil) != run.wantErr {
+				t.Fatalf("Run returned %v, want an error: %t", err, run.wantErr)
+			}
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Goroutines that have been told to stop may take a moment to exit.
+	after := runtime.NumGoroutine()
+	for i := 0; i < 100 && after > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > before {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutines before, %d after:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+// BenchmarkRun mirrors a site of small pages and a few large assets into an
+// empty bucket, where hashing the files overlaps uploading them.
+func BenchmarkRun(b *testing.B) {
+	site := map[string]string{}
+	for i := 0; i < 100; i++ {
+		site[fmt.Sprintf("pages/%03d.html", i)] = strings.Repeat(fmt.Sprintf("<p>Page %d.</p>\n", i), 100)
+	}
+	for i := 0; i < 4; i++ {
+		site[fmt.Sprintf("img/%d.jpg", i)] = strings.Repeat(string(rune('a'+i)), 4<<20)
+	}
+	var size int64
+	for _, contents := range site {
+		size += int64(len(contents))
+	}
+	repo := newTestRepo(b, site)
+	defer repo.remove()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bucket := memblob.OpenBucket(nil)
+		repo.run(bucket, WithConcurrency(4))
+		bucket.Close()
+	}
+}
@@ -0,0 +1,39 @@
+package mirror2s3
+
+import "fmt"
+
+const (
+	// minPartSize is the smallest part S3 accepts in a multipart upload.
+	minPartSize = 5 << 20
+	// maxUploadParts is the most parts S3 accepts in a multipart upload.
+	maxUploadParts = 10000
+	// singlePutLimit is the largest object S3 accepts in a single request.
+	singlePutLimit = 5 << 30
+	// maxObjectSize is the largest object S3 accepts at all.
+	maxObjectSize = 5 << 40
+)
+
+// checkSize returns an error if the file at key is too large to upload.
+func checkSize(key string, size int64) error {
+	if size > maxObjectSize {
+		return fmt.Errorf(`"%s" is %d bytes, larger than S3's maximum object size of %d`, key, size, int64(maxObjectSize))
+	}
+	return nil
+}
+
+// bufferSize returns the part size to upload a file of the given size in, or 0
+// for the default. Files over the single request limit are always uploaded in
+// parts, and parts are made large enough that there aren't too many of them.
+func (m *Mirror) bufferSize(size int64) int {
+	part := int64(m.partSize)
+	if part == 0 || size <= part {
+		if size <= singlePutLimit {
+			return 0
+		}
+		part = minPartSize
+	}
+	if min := (size + maxUploadParts - 1) / maxUploadParts; part < min {
+		part = min
+	}
+	return int(part)
+}
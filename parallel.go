@@ -0,0 +1,51 @@
+package mirror2s3
+
+import (
+	"context"
+	"sync"
+)
+
+// parallel calls fn(i) for each i in [0, count), running up to n calls at
+// once. It stops starting calls once ctx is done, and returns after all the
+// calls it started have returned.
+func parallel(ctx context.Context, n, count int, fn func(i int)) {
+	if n < 1 {
+		n = 1
+	}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < n && w < count; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				fn(i)
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < count; i++ {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,108 @@
+package mirror2s3
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// PlanFormat is a format for the list of changes written by WithPlanFormat.
+type PlanFormat string
+
+const (
+	// PlanText lists changes for people to read, followed by a summary.
+	PlanText PlanFormat = "text"
+	// PlanDiff lists one changed key per line, prefixed with "+" for new
+	// objects, "~" for changed objects, and "-" for deleted objects. Lines
+	// are sorted by key, so captured plans can be compared with diff.
+	PlanDiff PlanFormat = "diff"
+)
+
+// ChangeOp is what a Change does to an object.
+type ChangeOp int
+
+const (
+	// ChangeKeep leaves an object that's already up to date.
+	ChangeKeep ChangeOp = iota
+	// ChangeAdd uploads a file that isn't in the bucket.
+	ChangeAdd
+	// ChangeUpdate uploads a file over an object that's out of date.
+	ChangeUpdate
+	// ChangeDelete deletes an object.
+	ChangeDelete
+)
+
+// String returns the name of the op, like "add".
+func (op ChangeOp) String() string {
+	switch op {
+	case ChangeKeep:
+		return "keep"
+	case ChangeAdd:
+		return "add"
+	case ChangeUpdate:
+		return "update"
+	case ChangeDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("ChangeOp(%d)", int(op))
+}
+
+// Change is something Run did, or would do in a dry run, to an object.
+type Change struct {
+	Key string
+	Op  ChangeOp
+	// Disabled is true for deletes that WithNoDelete prevented.
+	Disabled bool
+	// Retyped is true for updates that only fix the content type.
+	Retyped bool
+}
+
+// writePlan writes the run's changes to w in the configured format.
+func (r *mirrorRun) writePlan(w io.Writer) error {
+	r.resMu.Lock()
+	changes := append([]Change(nil), r.res.Changes...)
+	r.resMu.Unlock()
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+
+	bw := bufio.NewWriter(w)
+	switch r.planFormat {
+	case PlanText:
+		writeTextPlan(bw, changes)
+	case PlanDiff:
+		writeDiffPlan(bw, changes)
+	default:
+		return fmt.Errorf(`unknown plan format "%s"`, r.planFormat)
+	}
+	return bw.Flush()
+}
+
+func writeTextPlan(w io.Writer, changes []Change) {
+	counts := map[ChangeOp]int{}
+	for _, c := range changes {
+		switch {
+		case c.Op == ChangeAdd:
+			fmt.Fprintf(w, "upload %s (new)\n", c.Key)
+		case c.Op == ChangeUpdate && c.Retyped:
+			fmt.Fprintf(w, "upload %s (content type changed)\n", c.Key)
+		case c.Op == ChangeUpdate:
+			fmt.Fprintf(w, "upload %s (changed)\n", c.Key)
+		case c.Op == ChangeDelete && c.Disabled:
+			fmt.Fprintf(w, "keep %s (deletes are disabled)\n", c.Key)
+			continue
+		case c.Op == ChangeDelete:
+			fmt.Fprintf(w, "delete %s\n", c.Key)
+		}
+		counts[c.Op]++
+	}
+	fmt.Fprintf(w, "%d new, %d changed, %d deleted, %d unchanged\n", counts[ChangeAdd], counts[ChangeUpdate], counts[ChangeDelete], counts[ChangeKeep])
+}
+
+func writeDiffPlan(w io.Writer, changes []Change) {
+	prefixes := map[ChangeOp]string{ChangeAdd: "+", ChangeUpdate: "~", ChangeDelete: "-"}
+	for _, c := range changes {
+		if prefix, ok := prefixes[c.Op]; ok && !c.Disabled {
+			fmt.Fprintf(w, "%s %s\n", prefix, c.Key)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package mirror2s3
+
+// Progress is what WithProgressFunc reports about one object.
+type Progress struct {
+	// Key is the object's key.
+	Key string
+	// Size is the size of the file in bytes, or 0 for a delete.
+	Size int64
+	// Op is what was done to the object: ChangeKeep if the file in the
+	// bucket was already up to date, and otherwise the upload or delete.
+	Op ChangeOp
+	// DryRun is true if the change was only planned; see WithDryRun.
+	DryRun bool
+}
+
+// WithProgressFunc makes Run call progress for each object once it has
+// been uploaded, found up to date, or deleted, or in a dry run, once it's
+// known what would be done. Like Instrumentation, it may be called from
+// several goroutines at once, and it holds up the upload or delete it
+// reports on until it returns.
+func WithProgressFunc(progress func(Progress)) func(*Mirror) {
+	return func(m *Mirror) {
+		m.progress = progress
+	}
+}
+
+// reportProgress calls the progress function, if there is one.
+func (r *mirrorRun) reportProgress(key string, size int64, op ChangeOp) {
+	if r.progress != nil {
+		r.progress(Progress{Key: key, Size: size, Op: op, DryRun: r.dryRun})
+	}
+}
@@ -0,0 +1,143 @@
+package mirror2s3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// pruneObjects deletes the objects in the bucket that aren't part of the
+// site. It keeps going when a delete fails, recording the failure.
+func (r *mirrorRun) pruneObjects(ctx context.Context) error {
+	keys, total, err := r.staleKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if err := r.checkDeleteThreshold(len(keys), total); err != nil {
+		return err
+	}
+	return r.deleteObjects(ctx, keys)
+}
+
+// checkDeleteThreshold returns ErrDeleteThresholdExceeded if deleting n of
+// the total objects in the bucket is more than the delete threshold allows.
+func (r *mirrorRun) checkDeleteThreshold(n, total int) error {
+	if r.deleteThreshold == 0 || r.forcePrune || n == 0 {
+		return nil
+	}
+	percent := 100 * float64(n) / float64(total)
+	if percent <= r.deleteThreshold {
+		return nil
+	}
+	return fmt.Errorf("%w: deleting %d of %d objects (%.1f%%) is more than the threshold of %g%%; see WithForcePrune",
+		ErrDeleteThresholdExceeded, n, total, percent, r.deleteThreshold)
+}
+
+// deleteObjects deletes the objects at keys, keeping going when a delete
+// fails and recording the failure.
+func (r *mirrorRun) deleteObjects(ctx context.Context, keys []string) error {
+	if r.noDelete {
+		for _, key := range keys {
+			r.logf("not deleting %s, deletes are disabled", key)
+			r.recordChange(Change{Key: key, Op: ChangeDelete, Disabled: true})
+		}
+		return nil
+	}
+	if r.dryRun {
+		for _, key := range keys {
+			r.logf("would delete %s…", key)
+			r.recordChange(Change{Key: key, Op: ChangeDelete})
+			r.reportProgress(key, 0, ChangeDelete)
+		}
+		return nil
+	}
+
+	errs := make([]error, len(keys))
+	done := make([]bool, len(keys))
+	parallel(ctx, r.concurrency, len(keys), func(i int) {
+		r.logf("deleting %s…", keys[i])
+		if errs[i] = r.deleteObject(ctx, keys[i]); errs[i] == nil {
+			r.reportProgress(keys[i], 0, ChangeDelete)
+		}
+		done[i] = true
+	})
+
+	failed := 0
+	for i, key := range keys {
+		switch {
+		case !done[i]:
+		case errs[i] != nil:
+			r.recordError(errs[i])
+			failed++
+		default:
+			r.recordDelete(key)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deletes failed", failed, len(keys))
+	}
+	return nil
+}
+
+// staleKeys returns the sorted keys of the objects to prune, and how many
+// objects there are, not counting mirror2s3's own.
+func (r *mirrorRun) staleKeys(ctx context.Context) ([]string, int, error) {
+	var keys []string
+	total := 0
+	err := r.eachRemote(ctx, func(obj *object) {
+		if !strings.HasPrefix(obj.key, r.keyPrefix+internalDir) {
+			total++
+		}
+		if r.isStale(obj) {
+			keys = append(keys, obj.key)
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(keys)
+	return keys, total, nil
+}
+
+// isStale reports whether obj should be pruned.
+func (r *mirrorRun) isStale(obj *object) bool {
+	if r.site[obj.key] || r.excludedKey(obj.key) != "" || r.keepIgnored(obj.key) {
+		return false
+	}
+	if r.pruneOlderThan > 0 && !obj.modTime.Before(r.started.Add(-r.pruneOlderThan)) {
+		// It may belong to a newer deploy.
+		return false
+	}
+	return true
+}
+
+// keepIgnored reports whether the object at key should survive pruning
+// because its name matches an ignore rule, like the file Run would have
+// skipped uploading.
+func (r *mirrorRun) keepIgnored(key string) bool {
+	if r.pruneIgnored {
+		return false
+	}
+	name := strings.TrimPrefix(key, r.keyPrefix)
+	return ignoreRule(name) != "" || r.gitignore.match(name) != "" || r.filter.rule(name) != ""
+}
+
+// deleteObject deletes the object at key. Every delete goes through here so
+// that WithNoDelete can't be bypassed.
+func (r *mirrorRun) deleteObject(ctx context.Context, key string) error {
+	if r.noDelete {
+		return &UploadError{Op: "delete", Key: key, Err: errDeletesDisabled}
+	}
+	err := r.retry(ctx, "delete", key, func() error {
+		r.countRequest(&r.res.Requests.Deletes)
+		return r.bucket.Delete(ctx, key)
+	})
+	if err != nil {
+		return &UploadError{Op: "delete", Key: key, Err: err}
+	}
+	return nil
+}
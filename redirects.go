@@ -0,0 +1,103 @@
+package mirror2s3
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// WithRedirectsFile makes Run read redirects from the file at name in the
+// site, which isn't uploaded. Each line of the file is a path and where to
+// redirect it, like:
+//
+//	# Moved in 2019.
+//	/old-page.html /new-page.html
+//	/docs https://docs.example.com/
+//
+// For each, Run uploads a placeholder object at the path that S3 website
+// endpoints redirect to the location, which must be a path starting with "/"
+// or an http or https URL. The placeholder's contents are the location, so
+// that changing it uploads it again. Only S3 supports redirects. Like extra
+// files, redirects are uploaded even when WithOnlyFiles or WithDiffRange
+// limits which of the site's files are, and it's an error for the site to
+// have a file at a redirect's path.
+func WithRedirectsFile(name string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.redirectsFile = normalizePath(name)
+	}
+}
+
+// siteRedirect is a line of the redirects file.
+type siteRedirect struct {
+	key, location string
+}
+
+// readRedirects returns the redirects in the redirects file in treeish, if
+// WithRedirectsFile is set.
+func (m *Mirror) readRedirects(treeish string) ([]siteRedirect, error) {
+	if m.redirectsFile == "" {
+		return nil, nil
+	}
+	data, ok, err := m.readSiteFile(treeish, m.redirectsFile)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("redirects file %s isn't in the site", m.redirectsFile)
+	}
+
+	var redirects []siteRedirect
+	for i, line := range strings.Split(data, "\n") {
+		if j := strings.Index(line, "#"); j >= 0 {
+			line = line[:j]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a path and a location", m.redirectsFile, i+1)
+		}
+		name, location := normalizePath(fields[0]), fields[1]
+		if name == "" {
+			return nil, fmt.Errorf("%s:%d: can't redirect the root of the site", m.redirectsFile, i+1)
+		}
+		if !strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+			return nil, fmt.Errorf(`%s:%d: location "%s" isn't a path starting with "/" or an http or https URL`, m.redirectsFile, i+1, location)
+		}
+		redirects = append(redirects, siteRedirect{key: m.keyPrefix + name, location: location})
+	}
+	return redirects, nil
+}
+
+// planRedirects adds the redirects' placeholders to p.
+func (m *Mirror) planRedirects(p *plan) error {
+	for _, redirect := range p.redirects {
+		if _, ok := p.sizes[redirect.key]; ok {
+			return fmt.Errorf(`redirect "%s" is also in the site`, redirect.key)
+		}
+		if m.excludedKey(redirect.key) == "" {
+			p.keys = append(p.keys, redirect.key)
+			p.sizes[redirect.key] = int64(len(redirect.location))
+		}
+	}
+	return nil
+}
+
+// sendRedirects sends the redirects' placeholders to files.
+func (m *Mirror) sendRedirects(ctx context.Context, plan *plan, files chan<- *file) error {
+	for _, redirect := range plan.redirects {
+		if reason := m.excludedKey(redirect.key); reason != "" {
+			m.logf("skipping %s, %s…", redirect.key, reason)
+			continue
+		}
+		f := m.newFile(redirect.key, []byte(redirect.location), "")
+		f.redirect = redirect.location
+		select {
+		case files <- f:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package mirror2s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"gocloud.dev/blob"
+)
+
+// defaultRegionHint is the region asked for a bucket's region when none is
+// configured. Any region can answer.
+const defaultRegionHint = "us-east-1"
+
+// WithAutoRegion makes Run look up the region of an S3 bucket, and use it
+// instead of the configured one if they differ, rather than failing with a
+// redirect error. The detected region is logged so that it can be set with
+// WithAwsRegion next time, which avoids the extra request. It can't be
+// combined with WithBucket.
+func WithAutoRegion(auto bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.autoRegion = auto
+	}
+}
+
+// checkAutoRegion returns an error if WithAutoRegion can't apply to the
+// bucket: one given to WithBucket, which it would have to reopen.
+func (m *Mirror) checkAutoRegion() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.autoRegion && m.bucket != nil && !m.ownsBucket {
+		return errors.New("auto region: a bucket given to WithBucket can't be reopened in its region")
+	}
+	return nil
+}
+
+// reopenInRegion returns bucket, or if it's an S3 bucket in a region other
+// than the one it was opened for, the same bucket opened in the right region,
+// closing bucket. If it fails, bucket is left open.
+func (m *Mirror) reopenInRegion(ctx context.Context, bucket *blob.Bucket) (*blob.Bucket, error) {
+	var svc *s3.S3
+	if !bucket.As(&svc) {
+		return bucket, nil
+	}
+	name, err := s3BucketName(m.bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	configured := aws.StringValue(svc.Config.Region)
+	hint := configured
+	if hint == "" {
+		hint = defaultRegionHint
+	}
+
+	sess, err := m.awsSession()
+	if err != nil {
+		return nil, err
+	}
+	region, err := s3manager.GetBucketRegion(ctx, sess, name, hint)
+	if err != nil {
+		return nil, fmt.Errorf("find bucket region: %w", err)
+	}
+	if region == configured {
+		return bucket, nil
+	}
+	m.logf("bucket %s is in region %s, not %q; set it with WithAwsRegion to skip looking it up", name, region, configured)
+
+	u, err := url.Parse(m.bucketURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("region", region)
+	u.RawQuery = q.Encode()
+	reopened, err := m.openBucketURL(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	bucket.Close()
+	return reopened, nil
+}
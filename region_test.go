@@ -0,0 +1,18 @@
+package mirror2s3
+
+import (
+	"testing"
+
+	"gocloud.dev/blob/memblob"
+)
+
+func TestCheckAutoRegion(t *testing.T) {
+	bucket := memblob.OpenBucket(nil)
+	defer bucket.Close()
+	if err := New(WithAutoRegion(true), WithBucket(bucket)).validate(); err == nil {
+		t.Error("auto region with WithBucket validated, want an error")
+	}
+	if err := New(WithAutoRegion(true), WithBucketURL("s3://site")).validate(); err != nil {
+		t.Errorf("auto region with a bucket URL: %v", err)
+	}
+}
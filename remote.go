@@ -0,0 +1,211 @@
+package mirror2s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// object is what Run knows about an object in the bucket.
+type object struct {
+	key     string
+	size    int64
+	md5     []byte
+	modTime time.Time
+	// sha256 is the object's checksum in hex, if it was read from the
+	// manifest rather than listed.
+	sha256 string
+	// commit is the commit the manifest says the object was uploaded from.
+	commit string
+	// etag is the object's ETag if it was uploaded in parts, so that it has
+	// no MD5.
+	etag string
+	// attrs is nil until it's needed; see mirrorRun.attributes.
+	attrs *blob.Attributes
+}
+
+// listRemote lists the whole bucket into r.remote.
+func (r *mirrorRun) listRemote(ctx context.Context) error {
+	r.remote = map[string]*object{}
+	withoutMD5 := 0
+	itr := r.bucket.List(r.listOptions())
+	for {
+		obj, err := itr.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &UploadError{Op: "list", Key: r.keyPrefix, Err: err}
+		}
+		if obj.IsDir {
+			continue
+		}
+		o := &object{key: obj.Key, size: obj.Size, md5: obj.MD5, modTime: obj.ModTime}
+		if obj.MD5 == nil {
+			if o.etag = multipartETagOf(obj.As); o.etag == "" {
+				withoutMD5++
+			}
+		}
+		r.remote[obj.Key] = o
+	}
+	if withoutMD5 > 0 && r.checksum == ChecksumMD5 && !r.sizeFallback {
+		r.logf("warning: the bucket lists no MD5 for %d of %d objects, so they will be uploaded again even if unchanged", withoutMD5, len(r.remote))
+		r.logf("warning: this usually means they were uploaded in parts, to a bucket that doesn't list multipart ETags to compare instead")
+		r.logf("warning: WithChecksumAlgorithm(ChecksumSHA256) compares checksums kept in metadata instead, and WithSizeFallback compares sizes and the last 4 KiB")
+	}
+	return nil
+}
+
+// maxListPageSize is the most objects S3 returns from one list request.
+const maxListPageSize = 1000
+
+// listOptions returns the options for listing the part of the bucket that
+// Run manages.
+func (m *Mirror) listOptions() *blob.ListOptions {
+	return m.pagedListOptions(m.listPageSize)
+}
+
+// pagedListOptions is like listOptions, but asks S3 for pages of at most
+// pageSize objects, if it isn't 0.
+func (m *Mirror) pagedListOptions(pageSize int) *blob.ListOptions {
+	opts := &blob.ListOptions{Prefix: m.keyPrefix, Delimiter: m.delimiter()}
+	if pageSize > 0 {
+		maxKeys := aws.Int64(int64(pageSize))
+		opts.BeforeList = func(as func(interface{}) bool) error {
+			var in *s3.ListObjectsV2Input
+			var legacyIn *s3.ListObjectsInput
+			if as(&in) {
+				in.MaxKeys = maxKeys
+			} else if as(&legacyIn) {
+				legacyIn.MaxKeys = maxKeys
+			}
+			return nil
+		}
+	}
+	return opts
+}
+
+// listOptions is like Mirror.listOptions, but counts the requests made.
+func (r *mirrorRun) listOptions() *blob.ListOptions {
+	opts := r.Mirror.listOptions()
+	beforeList := opts.BeforeList
+	opts.BeforeList = func(as func(interface{}) bool) error {
+		r.countRequest(&r.res.Requests.Lists)
+		if beforeList != nil {
+			return beforeList(as)
+		}
+		return nil
+	}
+	return opts
+}
+
+// eachRemote calls fn for every object in the bucket, from r.remote if the
+// bucket has been listed or the manifest read, or else by streaming a new
+// listing. The manifest doesn't have modification times, so the bucket is
+// listed anyway if they're needed.
+func (r *mirrorRun) eachRemote(ctx context.Context, fn func(*object)) error {
+	if r.remote != nil && (!r.fromManifest || r.pruneOlderThan == 0) {
+		for _, obj := range r.remote {
+			fn(obj)
+		}
+		return nil
+	}
+
+	itr := r.bucket.List(r.listOptions())
+	for {
+		obj, err := itr.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &UploadError{Op: "list", Key: r.keyPrefix, Err: err}
+		}
+		if obj.IsDir {
+			continue
+		}
+		fn(&object{key: obj.Key, size: obj.Size, md5: obj.MD5, modTime: obj.ModTime})
+	}
+}
+
+// lookup returns the object at key, or nil if there isn't one.
+func (r *mirrorRun) lookup(ctx context.Context, key string) (*object, error) {
+	if r.remote != nil {
+		return r.remote[key], nil
+	}
+
+	r.countRequest(&r.res.Requests.Gets)
+	attrs, err := r.bucket.Attributes(ctx, key)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj := &object{key: key, size: attrs.Size, md5: attrs.MD5, modTime: attrs.ModTime, attrs: attrs}
+	if obj.md5 == nil {
+		obj.etag = multipartETagOf(attrs.As)
+	}
+	return obj, nil
+}
+
+// attributes returns obj's attributes, fetching them if necessary.
+func (r *mirrorRun) attributes(ctx context.Context, obj *object) (*blob.Attributes, error) {
+	if obj.attrs == nil {
+		r.countRequest(&r.res.Requests.Gets)
+		attrs, err := r.bucket.Attributes(ctx, obj.key)
+		if err != nil {
+			return nil, &UploadError{Op: "get attributes", Key: obj.key, Err: err}
+		}
+		obj.attrs = attrs
+	}
+	return obj.attrs, nil
+}
+
+// prefetchAttributes fetches the attributes of the listed objects that the
+// comparisons will need them for, up to the concurrency limit at once, rather
+// than one at a time as the files come up. Only objects the site has a file of
+// the same size for are fetched. Failures are left for the comparisons to
+// retry and report.
+func (r *mirrorRun) prefetchAttributes(ctx context.Context, p *plan) {
+	var objs []*object
+	for _, key := range p.keys {
+		obj := r.remote[key]
+		if obj == nil || obj.attrs != nil {
+			continue
+		}
+		if size := p.sizes[key]; size >= 0 && size != obj.size {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	parallel(ctx, r.concurrency, len(objs), func(i int) {
+		r.countRequest(&r.res.Requests.Gets)
+		if attrs, err := r.bucket.Attributes(ctx, objs[i].key); err == nil {
+			objs[i].attrs = attrs
+		}
+	})
+}
+
+// checkEmpty returns ErrNotEmpty if there are any objects under the key
+// prefix, besides mirror2s3's own, such as the lock.
+func (r *mirrorRun) checkEmpty(ctx context.Context) error {
+	itr := r.bucket.List(r.listOptions())
+	for {
+		obj, err := itr.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &UploadError{Op: "list", Key: r.keyPrefix, Err: err}
+		}
+		if r.excludedKey(obj.Key) == "" {
+			return fmt.Errorf(`%w: found "%s"`, ErrNotEmpty, obj.Key)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package mirror2s3
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestPagedListOptions(t *testing.T) {
+	tests := []struct {
+		pageSize int
+		// want is the MaxKeys S3 is asked for, or 0 for its default.
+		want int64
+	}{
+		{0, 0},
+		{1, 1},
+		{500, 500},
+	}
+	for _, tt := range tests {
+		opts := New().pagedListOptions(tt.pageSize)
+		in := &s3.ListObjectsV2Input{}
+		if opts.BeforeList != nil {
+			err := opts.BeforeList(func(i interface{}) bool {
+				p, ok := i.(**s3.ListObjectsV2Input)
+				if ok {
+					*p = in
+				}
+				return ok
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := aws.Int64Value(in.MaxKeys); got != tt.want {
+			t.Errorf("page size %d: MaxKeys is %d, want %d", tt.pageSize, got, tt.want)
+		}
+	}
+}
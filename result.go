@@ -0,0 +1,118 @@
+package mirror2s3
+
+import "time"
+
+// Result describes what Run did.
+type Result struct {
+	// Ref is the git ref that was archived, as given to WithGitRef, or the
+	// directory given to WithDirectorySource.
+	Ref string
+	// CommitSHA is the commit Ref resolved to when Run started, or "" if Ref
+	// named a tree. The archive is made from this SHA, so a ref that moves
+	// mid-run can't mix files from two commits.
+	CommitSHA string
+
+	// Ignored is the files in the site that weren't uploaded because they
+	// matched an ignore rule, such as IgnoredFiles.
+	Ignored []IgnoredFile
+	// Uploaded is the keys of the objects that were written, in the order the
+	// writes finished.
+	Uploaded []string
+	// UploadedBytes is the total size of the objects in Uploaded.
+	UploadedBytes int64
+	// Skipped is the keys of the objects that were already up to date, in
+	// the order they were compared.
+	Skipped []string
+	// Retyped is the keys in Uploaded whose contents were already up to date,
+	// but whose content types weren't; see WithContentTypeReconcile.
+	Retyped []string
+	// Fingerprints maps the names of the files WithFingerprint renamed to
+	// their new names, both relative to the key prefix.
+	Fingerprints map[string]string
+	// Deleted is the keys of the objects that were pruned, in key order.
+	Deleted []string
+	// Invalidations is the IDs of the CloudFront invalidations Run created;
+	// see WithCloudFrontDistribution.
+	Invalidations []string
+	// Changes is everything Run did, or would have done in a dry run, to
+	// each object, in the order it was decided. WithPlanFormat writes it out.
+	Changes []Change
+	// Requests counts the requests Run made to the bucket.
+	Requests RequestCounts
+	// Duration is how long Run took.
+	Duration time.Duration
+	// Mismatches is the uploaded objects that didn't match their files, if
+	// WithVerify is set.
+	Mismatches []Mismatch
+	// Errors holds the failures Run kept going after, such as objects that
+	// couldn't be uploaded or deleted. Run's error summarizes them.
+	Errors []error
+}
+
+// IgnoredFile is a file in the site that Run didn't upload.
+type IgnoredFile struct {
+	// Name is the file's path in the site.
+	Name string
+	// Rule is the ignore rule it matched.
+	Rule string
+}
+
+// RequestCounts counts requests to the bucket by kind, to help estimate what
+// a Run costs. A multipart upload counts as a single PUT.
+type RequestCounts struct {
+	// Puts counts writes, including of the lock.
+	Puts int
+	// Gets counts reads, including reads of object metadata alone (HEAD
+	// requests).
+	Gets int
+	// Deletes counts deletes, whether or not they succeeded.
+	Deletes int
+	// Lists counts pages of bucket listings. It's only counted for buckets
+	// whose drivers report each page, such as S3.
+	Lists int
+}
+
+// The record methods update the Result and the plan. They're safe to call
+// from concurrent uploads and deletes.
+
+func (r *mirrorRun) recordChange(c Change) {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	r.res.Changes = append(r.res.Changes, c)
+}
+
+func (r *mirrorRun) recordSkip(f *file) {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	r.res.Skipped = append(r.res.Skipped, f.key)
+	r.res.Changes = append(r.res.Changes, Change{Key: f.key, Op: ChangeKeep})
+}
+
+func (r *mirrorRun) recordUpload(f *file, retyped bool) {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	r.res.Uploaded = append(r.res.Uploaded, f.key)
+	r.res.UploadedBytes += f.size
+	if retyped {
+		r.res.Retyped = append(r.res.Retyped, f.key)
+	}
+}
+
+func (r *mirrorRun) recordDelete(key string) {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	r.res.Deleted = append(r.res.Deleted, key)
+	r.res.Changes = append(r.res.Changes, Change{Key: key, Op: ChangeDelete})
+}
+
+func (r *mirrorRun) recordError(err error) {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	r.res.Errors = append(r.res.Errors, err)
+}
+
+func (r *mirrorRun) countRequest(count *int) {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	*count++
+}
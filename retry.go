@@ -0,0 +1,79 @@
+package mirror2s3
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gocloud.dev/gcerrors"
+)
+
+// RetryPolicy is how Run retries a failed upload, copy, or delete of an
+// object, for WithRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a request is made before giving up,
+	// including the first. 0 and 1 both mean it isn't retried.
+	MaxAttempts int
+	// InitialDelay is how long to wait before the first retry, or 0 for
+	// defaultRetryDelay. Each retry waits twice as long as the one before,
+	// up to MaxDelay.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between retries, if it isn't 0.
+	MaxDelay time.Duration
+}
+
+// defaultRetryDelay is the delay before the first retry if the retry policy
+// doesn't set one, so that retries always back off.
+const defaultRetryDelay = 100 * time.Millisecond
+
+// WithRetryPolicy makes Run retry requests about single objects that fail in
+// ways that may be transient, such as server errors, throttling, and
+// timeouts, with exponential backoff. Each delay is randomized to between
+// half and all of its nominal length, so that concurrent uploads don't retry
+// in lockstep. Requests the bucket refused, such as for lack of permission,
+// aren't retried. By default, nothing is retried.
+func WithRetryPolicy(policy RetryPolicy) func(*Mirror) {
+	return func(m *Mirror) {
+		m.retryPolicy = policy
+	}
+}
+
+// retry calls do until it succeeds, returns an error that isn't worth
+// retrying, or the retry policy's attempts run out, returning its last error.
+// op and key describe the request for the log.
+func (r *mirrorRun) retry(ctx context.Context, op, key string, do func() error) error {
+	delay := r.retryPolicy.InitialDelay
+	if delay == 0 {
+		delay = defaultRetryDelay
+	}
+	if max := r.retryPolicy.MaxDelay; max > 0 && delay > max {
+		delay = max
+	}
+	for attempt := 1; ; attempt++ {
+		err := do()
+		if err == nil || attempt >= r.retryPolicy.MaxAttempts || !isTransient(ctx, err) {
+			return err
+		}
+		wait := delay/2 + time.Duration(r.rand.Int63n(int64(delay/2)+1))
+		r.logf(`retrying %s "%s" in %v after attempt %d failed: %v`, op, key, wait, attempt, err)
+		if err := sleep(ctx, r.clock, wait); err != nil {
+			return err
+		}
+		if delay *= 2; r.retryPolicy.MaxDelay > 0 && delay > r.retryPolicy.MaxDelay {
+			delay = r.retryPolicy.MaxDelay
+		}
+	}
+}
+
+// isTransient reports whether err, from a request made with ctx, may not
+// happen again if the request is retried.
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || isAccessDenied(err) {
+		return false
+	}
+	switch gcerrors.Code(err) {
+	case gcerrors.Unknown, gcerrors.Internal, gcerrors.ResourceExhausted, gcerrors.DeadlineExceeded:
+		return true
+	}
+	return false
+}
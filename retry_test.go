@@ -0,0 +1,69 @@
+package mirror2s3
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"gocloud.dev/blob/memblob"
+)
+
+// newTestRun returns a mirrorRun of a Mirror made with options, for testing
+// the parts of Run that don't need a site.
+func newTestRun(options ...func(*Mirror)) *mirrorRun {
+	m := New(append([]func(*Mirror){WithLogOutput(ioutil.Discard)}, options...)...)
+	return &mirrorRun{Mirror: m, bucket: memblob.OpenBucket(nil), res: &Result{}, started: m.clock.Now()}
+}
+
+func TestRetryBacksOff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	// Each wait is jittered to between half and all of these.
+	nominal := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+
+	retry := func(seed int64) []time.Duration {
+		clock := newFakeClock()
+		r := newTestRun(WithRetryPolicy(policy), withClock(clock), withRandSeed(seed))
+		defer r.bucket.Close()
+		attempts := 0
+		err := r.retry(context.Background(), "upload", "index.html", func() error {
+			attempts++
+			return errors.New("transient")
+		})
+		if err == nil {
+			t.Fatal("retry succeeded, want the last attempt's error")
+		}
+		if attempts != policy.MaxAttempts {
+			t.Errorf("made %d attempts, want %d", attempts, policy.MaxAttempts)
+		}
+		return clock.Waits()
+	}
+
+	waits := retry(1)
+	if len(waits) != len(nominal) {
+		t.Fatalf("waited %v, want %d waits", waits, len(nominal))
+	}
+	for i, wait := range waits {
+		if wait < nominal[i]/2 || wait > nominal[i] {
+			t.Errorf("wait %d is %v, want between %v and %v", i, wait, nominal[i]/2, nominal[i])
+		}
+	}
+	if again := retry(1); !reflect.DeepEqual(again, waits) {
+		t.Errorf("with the same seed, waited %v, then %v", waits, again)
+	}
+}
+
+func TestRetryDefaultDelay(t *testing.T) {
+	clock := newFakeClock()
+	r := newTestRun(WithRetryPolicy(RetryPolicy{MaxAttempts: 2}), withClock(clock))
+	defer r.bucket.Close()
+	r.retry(context.Background(), "upload", "index.html", func() error {
+		return errors.New("transient")
+	})
+	waits := clock.Waits()
+	if len(waits) != 1 || waits[0] < defaultRetryDelay/2 || waits[0] > defaultRetryDelay {
+		t.Errorf("waited %v, want one wait between %v and %v", waits, defaultRetryDelay/2, defaultRetryDelay)
+	}
+}
@@ -0,0 +1,88 @@
+package mirror2s3
+
+import "fmt"
+
+// Rule sets headers on the objects for the files in the site whose names
+// match Glob, for WithObjectRules. Empty fields leave the header as it is.
+type Rule struct {
+	// Glob is matched against each file's path within the site, as with
+	// WithProtectedKeys: "assets/**" matches every file under assets, and
+	// "**/*.html" every HTML file.
+	Glob               string
+	CacheControl       string
+	ContentType        string
+	ContentDisposition string
+	ContentLanguage    string
+	// ACL is a canned ACL, as for WithACL.
+	ACL string
+	// Metadata is added to the object's metadata.
+	Metadata map[string]string
+}
+
+// WithObjectRules sets headers on the objects for the files matching each
+// rule, like:
+//
+//	WithObjectRules(
+//		Rule{Glob: "assets/**", CacheControl: "max-age=31536000, immutable"},
+//		Rule{Glob: "**/*.html", CacheControl: "no-cache"},
+//	)
+//
+// Files get the headers of every rule they match, with later rules taking
+// precedence. The rules take precedence over options that set a header for
+// every file, like WithCacheControl and WithACL, and over the site config.
+func WithObjectRules(rules ...Rule) func(*Mirror) {
+	return func(m *Mirror) {
+		m.objectRules = append(m.objectRules, rules...)
+	}
+}
+
+// checkObjectRules checks the globs of the rules set by WithObjectRules.
+func (m *Mirror) checkObjectRules() error {
+	var patterns []string
+	for _, rule := range m.objectRules {
+		patterns = append(patterns, rule.Glob)
+	}
+	if err := checkGlobs(patterns); err != nil {
+		return fmt.Errorf("object rules: %w", err)
+	}
+	return nil
+}
+
+// applyObjectRules sets the headers the rules have for f, the file at name.
+func (m *Mirror) applyObjectRules(f *file, name string) {
+	for _, rule := range m.objectRules {
+		if matchGlob(rule.Glob, name) {
+			m.applyRule(f, rule)
+		}
+	}
+}
+
+// applyRule sets the headers rule has on f.
+func (m *Mirror) applyRule(f *file, rule Rule) {
+	if rule.CacheControl != "" {
+		f.cacheControl = rule.CacheControl
+	}
+	if rule.ContentType != "" && !m.noContentType {
+		f.contentType = rule.ContentType
+	}
+	if rule.ContentDisposition != "" {
+		f.contentDisposition = rule.ContentDisposition
+	}
+	if rule.ContentLanguage != "" {
+		f.contentLanguage = rule.ContentLanguage
+	}
+	if rule.ACL != "" {
+		f.acl = rule.ACL
+	}
+	if len(rule.Metadata) > 0 {
+		// f.metadata may be shared with the site config's rules.
+		metadata := make(map[string]string, len(f.metadata)+len(rule.Metadata))
+		for k, v := range f.metadata {
+			metadata[k] = v
+		}
+		for k, v := range rule.Metadata {
+			metadata[k] = v
+		}
+		f.metadata = metadata
+	}
+}
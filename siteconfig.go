@@ -0,0 +1,111 @@
+package mirror2s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// SiteConfigFile is the name of the optional file at the root of the site
+// that sets headers for its files. It's never uploaded. It holds a list of
+// rules like:
+//
+//	{"rules": [
+//		{"match": "assets/**", "cacheControl": "public, max-age=86400"},
+//		{"match": "downloads/*.zip", "contentDisposition": "attachment"},
+//		{"match": "*.html", "contentLanguage": "en", "metadata": {"team": "web"}}
+//	]}
+//
+// A rule can also set "contentType". Files get the headers of every rule
+// whose glob matches their path within the site, with later rules taking
+// precedence. Headers set with options, like WithCacheControl, take
+// precedence over the config.
+const SiteConfigFile = ".mirror.json"
+
+// siteConfig is the contents of the site config file.
+type siteConfig struct {
+	Rules []siteRule `json:"rules"`
+}
+
+// siteRule sets headers for the files matching a glob.
+type siteRule struct {
+	Match              string            `json:"match"`
+	CacheControl       string            `json:"cacheControl"`
+	ContentType        string            `json:"contentType"`
+	ContentDisposition string            `json:"contentDisposition"`
+	ContentLanguage    string            `json:"contentLanguage"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+// readSiteConfig returns the site config in treeish, or nil if there isn't
+// one.
+func (m *Mirror) readSiteConfig(treeish string) (*siteConfig, error) {
+	data, ok, err := m.readSiteFile(treeish, SiteConfigFile)
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	var config siteConfig
+	dec := json.NewDecoder(bytes.NewReader([]byte(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %w", SiteConfigFile, err)
+	}
+	var patterns []string
+	for _, rule := range config.Rules {
+		patterns = append(patterns, rule.Match)
+	}
+	if err := checkGlobs(patterns); err != nil {
+		return nil, fmt.Errorf("%s: %w", SiteConfigFile, err)
+	}
+	return &config, nil
+}
+
+// rule returns the headers the config sets for the file at name.
+func (c *siteConfig) rule(name string) siteRule {
+	var merged siteRule
+	if c == nil {
+		return merged
+	}
+	for _, rule := range c.Rules {
+		if !matchGlob(rule.Match, name) {
+			continue
+		}
+		if rule.CacheControl != "" {
+			merged.CacheControl = rule.CacheControl
+		}
+		if rule.ContentType != "" {
+			merged.ContentType = rule.ContentType
+		}
+		if rule.ContentDisposition != "" {
+			merged.ContentDisposition = rule.ContentDisposition
+		}
+		if rule.ContentLanguage != "" {
+			merged.ContentLanguage = rule.ContentLanguage
+		}
+		for k, v := range rule.Metadata {
+			if merged.Metadata == nil {
+				merged.Metadata = map[string]string{}
+			}
+			merged.Metadata[k] = v
+		}
+	}
+	return merged
+}
+
+// applySiteConfig sets the headers the config has for f, the file at name,
+// where options haven't set them already.
+func (m *Mirror) applySiteConfig(c *siteConfig, f *file, name string) {
+	rule := c.rule(name)
+	if rule.CacheControl != "" && f.cacheControl == "" {
+		f.cacheControl = rule.CacheControl
+	}
+	if rule.ContentType != "" && !m.noContentType && !m.hasContentTypeOption(name) {
+		f.contentType = rule.ContentType
+	}
+	if rule.ContentLanguage != "" && f.contentLanguage == "" {
+		f.contentLanguage = rule.ContentLanguage
+	}
+	f.contentDisposition = rule.ContentDisposition
+	f.metadata = rule.Metadata
+}
@@ -0,0 +1,132 @@
+package mirror2s3
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// WithDirectorySource makes Run mirror the files in dir, such as the output
+// of a static site generator, instead of archiving a git ref. Files are
+// compared, skipped, and uploaded just as they are from git, and the site
+// config and .gitignore are read from the root of dir. Symlinks are skipped,
+// as they are in git, and so is any .git directory.
+//
+// There's no commit to report, so Result.Ref is dir and Result.CommitSHA is
+// "". WithDiffRange needs git, so it can't be used with a directory.
+func WithDirectorySource(dir string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.directorySource = dir
+	}
+}
+
+// checkDirectorySource checks that the directory set by WithDirectorySource
+// exists, and that no option that needs git is set with it.
+func (m *Mirror) checkDirectorySource() error {
+	if m.directorySource == "" {
+		return nil
+	}
+	if m.diffFrom != "" {
+		return errors.New("a diff range needs a git source, not a directory")
+	}
+	return checkDir(m.directorySource)
+}
+
+// readSiteFile returns the contents of the file at name in the root of the
+// site, and false if there's no such file.
+func (m *Mirror) readSiteFile(treeish, name string) (string, bool, error) {
+	if m.directorySource != "" {
+		data, err := ioutil.ReadFile(filepath.Join(m.directorySource, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			return "", false, nil
+		} else if err != nil {
+			return "", false, err
+		}
+		return string(data), true, nil
+	}
+
+	obj := treeish + ":" + name
+	if _, err := m.gitOutput("cat-file", "-e", obj); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	data, err := m.gitOutput("cat-file", "blob", obj)
+	if err != nil {
+		return "", false, err
+	}
+	return data, true, nil
+}
+
+// directoryTar returns a tar of the directory set by WithDirectorySource, in
+// the form git archive makes, so that it's read just like a git tree.
+func (m *Mirror) directoryTar() *siteTar {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeDirectoryTar(pw, m.directorySource))
+	}()
+	return &siteTar{Reader: tar.NewReader(pr), stdout: pr, archive: pr}
+}
+
+// writeDirectoryTar writes a tar of the files under dir to w, with names
+// relative to dir.
+func writeDirectoryTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		header := &tar.Header{Name: filepath.ToSlash(rel), Mode: int64(info.Mode().Perm()), ModTime: info.ModTime()}
+		switch {
+		case info.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+		case info.Mode()&os.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			if header.Linkname, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			header.Typeflag = tar.TypeReg
+			header.Size = info.Size()
+		default:
+			// Sockets, devices, and the like aren't files git could hold.
+			return nil
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.CopyN(tw, f, header.Size); err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
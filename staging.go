@@ -0,0 +1,91 @@
+package mirror2s3
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gocloud.dev/blob"
+)
+
+// stagedFile is a file uploaded to the staging prefix, waiting to be
+// promoted. Its contents aren't kept; they're copied within the bucket.
+type stagedFile struct {
+	key      string
+	acl      string
+	redirect string
+}
+
+// stagingKey returns the key to stage the file at key under.
+func (r *mirrorRun) stagingKey(key string) string {
+	id := r.res.CommitSHA
+	if id == "" {
+		id = r.treeish
+	}
+	return r.keyPrefix + internalDir + "staging-" + id + "/" + key
+}
+
+// isStaged reports whether f should be uploaded to the staging prefix. Files
+// too large for S3 to copy in one request are uploaded in place.
+func (r *mirrorRun) isStaged(f *file) bool {
+	return r.staged && f.size <= singlePutLimit
+}
+
+// promote copies the staged files to their keys, then deletes the staged
+// copies.
+func (r *mirrorRun) promote(ctx context.Context) error {
+	errs := make([]error, len(r.stagedFiles))
+	parallel(ctx, r.concurrency, len(r.stagedFiles), func(i int) {
+		s := r.stagedFiles[i]
+		r.logf("promoting %s…", s.key)
+		err := r.retry(ctx, "copy", s.key, func() error {
+			r.countRequest(&r.res.Requests.Puts)
+			return r.bucket.Copy(ctx, s.key, r.stagingKey(s.key), &blob.CopyOptions{BeforeCopy: beforeCopy(s)})
+		})
+		if err != nil {
+			errs[i] = &UploadError{Op: "copy", Key: s.key, Err: err}
+		}
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil {
+			// The staged files are left for the next Run to overwrite.
+			return err
+		}
+	}
+
+	if r.noDelete {
+		r.logf("not deleting the staged files, deletes are disabled")
+		return nil
+	}
+	parallel(ctx, r.concurrency, len(r.stagedFiles), func(i int) {
+		if err := r.deleteObject(ctx, r.stagingKey(r.stagedFiles[i].key)); err != nil {
+			r.logf("warning: clean up staged file: %v", err)
+		}
+	})
+	return ctx.Err()
+}
+
+// beforeCopy returns the BeforeCopy function for promoting s. S3 copies an
+// object's metadata, but not its ACL or website redirect.
+func beforeCopy(s stagedFile) func(func(interface{}) bool) error {
+	if s.acl == "" && s.redirect == "" {
+		return nil
+	}
+	return func(as func(interface{}) bool) error {
+		var in *s3.CopyObjectInput
+		if !as(&in) {
+			return errors.New("ACLs and redirects are only supported by S3")
+		}
+		if s.acl != "" {
+			in.ACL = aws.String(s.acl)
+		}
+		if s.redirect != "" {
+			in.WebsiteRedirectLocation = aws.String(s.redirect)
+		}
+		return nil
+	}
+}
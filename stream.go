@@ -0,0 +1,183 @@
+package mirror2s3
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"gocloud.dev/blob"
+)
+
+// WithStreamThreshold makes Run keep the files in the site larger than size
+// bytes out of memory. Each is copied from the archive to a temporary file,
+// hashing it on the way, and if it has changed, streamed from there to the
+// bucket, so a site with a 2 GB video needs little more memory than one
+// without. Smaller files are held in memory as usual. The default, 0, holds
+// every file in memory.
+//
+// Streamed files aren't compressed by WithCompression or WithGzipSiblings,
+// and a threshold can't be combined with WithTransform, which needs each
+// file's contents in memory.
+func WithStreamThreshold(size int64) func(*Mirror) {
+	return func(m *Mirror) {
+		m.streamThreshold = size
+	}
+}
+
+// streams reports whether the tar entry is a file to stream rather than
+// read into memory.
+func (m *Mirror) streams(header *tar.Header) bool {
+	return m.streamThreshold > 0 && header.Typeflag == tar.TypeReg && header.Size > m.streamThreshold
+}
+
+// spooledFile is the contents of a streamed file, on disk.
+type spooledFile struct {
+	path   string
+	size   int64
+	md5    [md5.Size]byte
+	sha256 []byte
+}
+
+// spool keeps the contents of a Run's streamed files in a temporary
+// directory, which is made when the first file is written.
+type spool struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// write copies r to a new file in the spool, computing its checksums.
+func (s *spool) write(r io.Reader, withSHA256 bool) (*spooledFile, error) {
+	s.mu.Lock()
+	if s.dir == "" {
+		dir, err := ioutil.TempDir("", "mirror2s3-")
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		s.dir = dir
+	}
+	dir := s.dir
+	s.mu.Unlock()
+
+	out, err := ioutil.TempFile(dir, "file-")
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	md5Hash := md5.New()
+	w := io.MultiWriter(out, md5Hash)
+	var sha256Hash hash.Hash
+	if withSHA256 {
+		sha256Hash = sha256.New()
+		w = io.MultiWriter(w, sha256Hash)
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+
+	spooled := &spooledFile{path: out.Name(), size: n}
+	copy(spooled.md5[:], md5Hash.Sum(nil))
+	if sha256Hash != nil {
+		spooled.sha256 = sha256Hash.Sum(nil)
+	}
+	return spooled, nil
+}
+
+// remove deletes the spool and the files in it.
+func (s *spool) remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(s.dir)
+	s.dir = ""
+	return err
+}
+
+// newSpooledFile is like newFile, for a file whose contents are spooled.
+func (m *Mirror) newSpooledFile(key string, spooled *spooledFile, contentType string) *file {
+	f := m.newFile(key, nil, contentType)
+	f.spooled, f.size, f.md5, f.sha256 = spooled, spooled.size, spooled.md5, spooled.sha256
+	return f
+}
+
+// open returns a reader of f's contents.
+func (f *file) open() (io.ReadCloser, error) {
+	if f.spooled == nil {
+		return ioutil.NopCloser(bytes.NewReader(f.data)), nil
+	}
+	return os.Open(f.spooled.path)
+}
+
+// readAt returns up to n bytes of f's contents, starting at offset.
+func (f *file) readAt(offset, n int64) ([]byte, error) {
+	if f.spooled == nil {
+		end := offset + n
+		if end > f.size {
+			end = f.size
+		}
+		return f.data[offset:end], nil
+	}
+	return f.spooled.readAt(offset, n)
+}
+
+// readAt returns up to n bytes of the spooled file, starting at offset.
+func (s *spooledFile) readAt(offset, n int64) ([]byte, error) {
+	in, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	buf := make([]byte, n)
+	read, err := in.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:read], nil
+}
+
+// write uploads f to key in the bucket, streaming it from the spool if it
+// was spooled.
+func (r *mirrorRun) write(ctx context.Context, key string, f *file, opts *blob.WriterOptions) error {
+	if f.spooled == nil {
+		return r.bucket.WriteAll(ctx, key, f.data, opts)
+	}
+	in, err := os.Open(f.spooled.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Like WriteAll, have the upload checked against the MD5.
+	opts.ContentMD5 = f.md5[:]
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w, err := r.bucket.NewWriter(ctx, key, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		// Canceling the context aborts the upload.
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// needsSHA256 reports whether files' SHA-256 checksums are needed, for the
+// checksum algorithm or the manifest.
+func (m *Mirror) needsSHA256() bool {
+	return m.checksum == ChecksumSHA256 || m.manifestChecksums
+}
@@ -0,0 +1,165 @@
+package mirror2s3
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WithSubmodules makes Run mirror the files in the site's git submodules, at
+// the commits the ref records for them, as if they were part of the site.
+// Without it, submodules are left out, as git archive leaves them out. Each
+// submodule must be checked out (git submodule update --init --recursive),
+// since their commits are read from their own repositories.
+func WithSubmodules(submodules bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.submodules = submodules
+	}
+}
+
+// submodule is a submodule of a git tree.
+type submodule struct {
+	// name is the submodule's path in the site, and dir where it's checked
+	// out.
+	name, dir string
+	// commit is the commit the tree records for it.
+	commit string
+}
+
+// listSubmodules returns the submodules of treeish, recursively. treeish is
+// read by git run in dir, where it's checked out, and the names of the
+// submodules are under prefix.
+func (m *Mirror) listSubmodules(cmd func(args ...string) *exec.Cmd, dir, treeish, prefix string) ([]submodule, error) {
+	c := cmd("ls-tree", "-r", "-z", treeish)
+	c.Stderr = nil
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("list submodules of %s: %w", treeish, err)
+	}
+	var subs []submodule
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// Entries are "<mode> <type> <object>\t<path>".
+		i := strings.IndexByte(entry, '\t')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(entry[:i])
+		if len(fields) != 3 || fields[1] != "commit" {
+			continue
+		}
+		sub := submodule{
+			name:   path.Join(prefix, entry[i+1:]),
+			dir:    filepath.Join(dir, filepath.FromSlash(entry[i+1:])),
+			commit: fields[2],
+		}
+		if _, err := os.Stat(filepath.Join(sub.dir, ".git")); err != nil {
+			return nil, fmt.Errorf("submodule %s isn't checked out (git submodule update --init --recursive)", sub.name)
+		}
+		nested, err := m.listSubmodules(m.submoduleCommand(sub.dir), sub.dir, sub.commit, sub.name)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+		subs = append(subs, nested...)
+	}
+	return subs, nil
+}
+
+// submoduleCommand returns a function that makes commands running git in the
+// submodule checked out in dir.
+func (m *Mirror) submoduleCommand(dir string) func(args ...string) *exec.Cmd {
+	return func(args ...string) *exec.Cmd {
+		return &exec.Cmd{
+			Path:   m.gitPath,
+			Args:   append([]string{m.gitPath}, args...),
+			Env:    []string{},
+			Dir:    dir,
+			Stderr: gitLog{m},
+		}
+	}
+}
+
+// addSubmodules returns a tar of the files in t followed by those of the
+// submodules of treeish.
+func (m *Mirror) addSubmodules(t *siteTar, treeish string) (*siteTar, error) {
+	top, err := m.gitOutput("rev-parse", "--show-toplevel")
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("find the work tree: %w", err)
+	}
+	// A ref like "HEAD:website" is a directory of the work tree.
+	root := top
+	if i := strings.Index(m.gitRef, ":"); i >= 0 {
+		root = filepath.Join(top, filepath.FromSlash(m.gitRef[i+1:]))
+	}
+	subs, err := m.listSubmodules(m.gitCommand, root, treeish, "")
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(m.writeWithSubmodules(pw, t, subs))
+	}()
+	return &siteTar{Reader: tar.NewReader(pr), stdout: pr, archive: pr}, nil
+}
+
+// writeWithSubmodules writes the files in t, then those in each of subs, to
+// w as a single tar.
+func (m *Mirror) writeWithSubmodules(w io.Writer, t *siteTar, subs []submodule) error {
+	tw := tar.NewWriter(w)
+	if err := copyTar(tw, t.Reader); err != nil {
+		t.Close()
+		return err
+	}
+	if err := t.finish(); err != nil {
+		return fmt.Errorf("git archive: %w", err)
+	}
+	for _, sub := range subs {
+		cmd := m.submoduleCommand(sub.dir)("archive", "--format=tar", "--prefix="+sub.name+"/", sub.commit)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("get git stdout: %w", err)
+		}
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("start git: %w", err)
+		}
+		st := &siteTar{Reader: tar.NewReader(stdout), stdout: stdout, archive: stdout, cmd: cmd}
+		if err := copyTar(tw, st.Reader); err != nil {
+			st.Close()
+			return err
+		}
+		if err := st.finish(); err != nil {
+			return fmt.Errorf("git archive of submodule %s: %w", sub.name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// copyTar copies the entries read by tr to tw, less git's global header.
+func copyTar(tw *tar.Writer, tr *tar.Reader) error {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
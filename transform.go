@@ -0,0 +1,117 @@
+package mirror2s3
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"gocloud.dev/blob"
+)
+
+// Transform rewrites a file before it's uploaded to key, returning the new
+// contents and, if it encoded them, the content encoding it used, such as
+// "gzip", or "" if it didn't.
+type Transform func(key string, in io.Reader) (out io.Reader, contentEncoding string, err error)
+
+// WithTransform adds a transform for Run to apply to each file, after its
+// content type has been chosen and before it's compared with the bucket, so
+// files whose transformed contents are unchanged are still skipped.
+// Transforms are applied in the order they were added, each to the output of
+// the one before; the content encodings they report are combined in the same
+// order.
+func WithTransform(transform Transform) func(*Mirror) {
+	return func(m *Mirror) {
+		m.transforms = append(m.transforms, func(key string, in io.Reader) (string, io.Reader, *blob.WriterOptions, error) {
+			out, contentEncoding, err := transform(key, in)
+			if err != nil || contentEncoding == "" {
+				return "", out, nil, err
+			}
+			return "", out, &blob.WriterOptions{ContentEncoding: contentEncoding}, nil
+		})
+	}
+}
+
+// Rewrite is a Transform that can also move a file to a new key, returning
+// it, or "" to leave the file at key, and set the headers it's uploaded with.
+// Of the options it returns, ContentType, CacheControl, ContentDisposition,
+// ContentEncoding, ContentLanguage, and Metadata are used, taking precedence
+// over every other option and the site config where they're set. opts may
+// be nil.
+type Rewrite func(key string, in io.Reader) (newKey string, out io.Reader, opts *blob.WriterOptions, err error)
+
+// WithRewrite adds a rewrite for Run to apply to each file, as with
+// WithTransform; transforms and rewrites are applied in the order they were
+// all added, each given the key and contents the one before left. A file can
+// be moved anywhere under the key prefix. A file that's moved isn't
+// fingerprinted, and, as with WithFingerprint, it can't be combined with
+// WithDeleteBeforeUpload, and Diff and WithDiffRange deal in the files'
+// names, not their new keys.
+func WithRewrite(rewrite Rewrite) func(*Mirror) {
+	return func(m *Mirror) {
+		m.transforms = append(m.transforms, rewrite)
+		m.movesFiles = true
+	}
+}
+
+// transform applies the transforms and rewrites to data, the contents of
+// the file at key, returning the result, its key, and the headers set for
+// it, including the content encoding.
+func (m *Mirror) transform(key string, data []byte) ([]byte, string, *blob.WriterOptions, error) {
+	headers := &blob.WriterOptions{}
+	for _, transform := range m.transforms {
+		newKey, out, opts, err := transform(key, bytes.NewReader(data))
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if data, err = ioutil.ReadAll(out); err != nil {
+			return nil, "", nil, err
+		}
+		if newKey != "" && newKey != key {
+			if !strings.HasPrefix(newKey, m.keyPrefix) || newKey == m.keyPrefix {
+				return nil, "", nil, fmt.Errorf(`can't move "%s" to "%s", which isn't under the key prefix`, key, newKey)
+			}
+			key = newKey
+		}
+		if opts != nil {
+			mergeWriterOptions(headers, opts)
+		}
+	}
+	return data, key, headers, nil
+}
+
+// mergeWriterOptions sets the headers of opts in headers: content encodings
+// are combined, in order, and the others replace those already there.
+func mergeWriterOptions(headers, opts *blob.WriterOptions) {
+	if opts.ContentEncoding != "" {
+		if headers.ContentEncoding != "" {
+			headers.ContentEncoding += ", "
+		}
+		headers.ContentEncoding += opts.ContentEncoding
+	}
+	if opts.ContentType != "" {
+		headers.ContentType = opts.ContentType
+	}
+	if opts.CacheControl != "" {
+		headers.CacheControl = opts.CacheControl
+	}
+	if opts.ContentDisposition != "" {
+		headers.ContentDisposition = opts.ContentDisposition
+	}
+	if opts.ContentLanguage != "" {
+		headers.ContentLanguage = opts.ContentLanguage
+	}
+	for k, v := range opts.Metadata {
+		if headers.Metadata == nil {
+			headers.Metadata = map[string]string{}
+		}
+		headers.Metadata[k] = v
+	}
+}
+
+// rewritesFiles reports whether files may be rewritten before they're
+// uploaded, so that their sizes aren't known until they've been read.
+func (m *Mirror) rewritesFiles() bool {
+	return len(m.transforms) > 0 || m.compression != ""
+}
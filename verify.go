@@ -0,0 +1,116 @@
+package mirror2s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+)
+
+// WithVerify makes Run check each object it uploads once the uploads are
+// done, by reading its attributes back: its size must be the file's, and its
+// MD5, or for objects uploaded to S3 in parts, its ETag, must be the file's
+// too. Objects that don't match are listed in Result.Mismatches, and fail the
+// Run before anything is pruned. Buckets that report neither checksum only
+// have sizes checked. It costs a request per upload.
+func WithVerify(verify bool) func(*Mirror) {
+	return func(m *Mirror) {
+		m.verify = verify
+	}
+}
+
+// Mismatch is an uploaded object that doesn't match its file; see WithVerify.
+type Mismatch struct {
+	Key string
+	// Problem is how it differs, like "is 100 bytes, not 200".
+	Problem string
+}
+
+// uploadedSum is what an uploaded object should have, to verify it.
+type uploadedSum struct {
+	size int64
+	md5  []byte
+	// etag is what its ETag should be if it was uploaded in parts, or "" if it
+	// was small enough not to be. Copies of it, as made by promoting staged
+	// files, are expected to have MD5s instead.
+	etag string
+}
+
+// recordUploadedSum notes what f's object should have, if it's to be
+// verified.
+func (r *mirrorRun) recordUploadedSum(f *file) error {
+	if !r.verify {
+		return nil
+	}
+	sum := uploadedSum{size: f.size, md5: f.md5[:]}
+	if partSize := r.uploadPartSize(f.size); f.size >= partSize {
+		var err error
+		if sum.etag, err = f.multipartETag(partSize); err != nil {
+			return fmt.Errorf("compute multipart ETag: %w", err)
+		}
+	}
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	if r.uploadedSums == nil {
+		r.uploadedSums = map[string]uploadedSum{}
+	}
+	r.uploadedSums[f.key] = sum
+	return nil
+}
+
+// verifyUploads checks the uploaded objects against their files.
+func (r *mirrorRun) verifyUploads(ctx context.Context) error {
+	keys := make([]string, 0, len(r.uploadedSums))
+	for key := range r.uploadedSums {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	r.logf("verifying %d uploaded objects…", len(keys))
+
+	problems := make([]string, len(keys))
+	parallel(ctx, r.concurrency, len(keys), func(i int) {
+		problems[i] = r.verifyUpload(ctx, keys[i], r.uploadedSums[keys[i]])
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for i, problem := range problems {
+		if problem != "" {
+			r.res.Mismatches = append(r.res.Mismatches, Mismatch{Key: keys[i], Problem: problem})
+		}
+	}
+	if len(r.res.Mismatches) > 0 {
+		first := r.res.Mismatches[0]
+		return fmt.Errorf(`%d of %d uploaded objects don't match their files, the first: "%s" %s`, len(r.res.Mismatches), len(keys), first.Key, first.Problem)
+	}
+	return nil
+}
+
+// verifyUpload returns how the object at key differs from sum, or "" if it
+// doesn't.
+func (r *mirrorRun) verifyUpload(ctx context.Context, key string, sum uploadedSum) string {
+	var obj *object
+	err := r.retry(ctx, "verify", key, func() error {
+		r.countRequest(&r.res.Requests.Gets)
+		attrs, err := r.bucket.Attributes(ctx, key)
+		if err != nil {
+			return err
+		}
+		obj = &object{key: key, size: attrs.Size, md5: attrs.MD5}
+		if obj.md5 == nil {
+			obj.etag = multipartETagOf(attrs.As)
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+		return fmt.Sprintf("couldn't be read: %v", err)
+	case obj.size != sum.size:
+		return fmt.Sprintf("is %d bytes, not %d", obj.size, sum.size)
+	case obj.md5 != nil && !bytes.Equal(obj.md5, sum.md5):
+		return fmt.Sprintf("has MD5 %x, not %x", obj.md5, sum.md5)
+	case obj.etag != "" && obj.etag != sum.etag:
+		return fmt.Sprintf(`has ETag "%s", not "%s"`, obj.etag, sum.etag)
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package mirror2s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// WithWatchDebounce makes Watch wait until the ref has stopped changing for d
+// before mirroring it, so that a burst of pushes is mirrored once, at its
+// last commit. By default, Watch mirrors whatever the ref is when it checks.
+func WithWatchDebounce(d time.Duration) func(*Mirror) {
+	return func(m *Mirror) {
+		m.watchDebounce = d
+	}
+}
+
+// WithWatchFetch makes Watch run "git fetch remote" before each check, for
+// watching a clone of a repository hosted elsewhere. The ref given to
+// WithGitRef should then be a remote-tracking branch, like "origin/main".
+// Unlike Run's other git commands, fetches get the process's environment, so
+// that they can use the user's credentials.
+func WithWatchFetch(remote string) func(*Mirror) {
+	return func(m *Mirror) {
+		m.watchFetch = remote
+	}
+}
+
+// Watch mirrors the site when it starts and again each time the ref given to
+// WithGitRef changes, checking every interval, until ctx is done, when it
+// returns ctx's error. A Run that fails is logged and tried again at the next
+// check, whether or not the ref has changed. WatchHandler makes Watch check
+// right away. A site from WithDirectorySource can't be watched.
+func (m *Mirror) Watch(ctx context.Context, interval time.Duration) error {
+	ctx = m.runContext(ctx)
+	if interval <= 0 {
+		return fmt.Errorf("watch interval %v isn't positive", interval)
+	}
+	if m.directorySource != "" {
+		return errors.New("a directory source has no commits to watch")
+	}
+	if err := m.validate(); err != nil {
+		return err
+	}
+
+	tick, stop := m.clock.Tick(interval)
+	defer stop()
+	var mirrored string
+	for {
+		var err error
+		if mirrored, err = m.mirrorChange(ctx, mirrored); err != nil {
+			return err
+		}
+		select {
+		case <-tick:
+		case <-m.watchChecks:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// mirrorChange runs a Run if the ref no longer resolves to mirrored, the tree
+// last mirrored, and returns the tree mirrored now. It only returns an error
+// if ctx is done.
+func (m *Mirror) mirrorChange(ctx context.Context, mirrored string) (string, error) {
+	if m.watchFetch != "" {
+		cmd := m.gitCommand("fetch", "--quiet", m.watchFetch)
+		cmd.Env = os.Environ()
+		if err := cmd.Run(); err != nil {
+			m.logf("warning: git fetch %s failed, checking the ref anyway: %v", m.watchFetch, err)
+		}
+	}
+	treeish, _, err := m.resolveRef(m.gitRef)
+	if err != nil {
+		m.logf("warning: not mirroring: %v", err)
+		return mirrored, nil
+	}
+	if treeish == mirrored {
+		return mirrored, nil
+	}
+	for m.watchDebounce > 0 {
+		if err := sleep(ctx, m.clock, m.watchDebounce); err != nil {
+			return mirrored, err
+		}
+		latest, _, err := m.resolveRef(m.gitRef)
+		if err != nil {
+			m.logf("warning: not mirroring: %v", err)
+			return mirrored, nil
+		}
+		if latest == treeish {
+			break
+		}
+		treeish = latest
+	}
+
+	m.logf("mirroring %s (%s)…", m.gitRef, treeish)
+	if _, err := m.Run(ctx); err != nil {
+		if ctx.Err() != nil {
+			return mirrored, ctx.Err()
+		}
+		m.logf("warning: mirroring %s failed, trying again at the next check: %v", m.gitRef, err)
+		return mirrored, nil
+	}
+	// Run resolved the ref itself, so it may have mirrored a later commit;
+	// if so, the next check mirrors it again, which changes nothing.
+	return treeish, nil
+}
+
+// WatchHandler returns an HTTP handler that makes Watch check the ref right
+// away, for git hosts' push webhooks. It accepts POST requests with any body.
+// It doesn't check who they're from, as they can only cause a check.
+func (m *Mirror) WatchHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		select {
+		case m.watchChecks <- struct{}{}:
+		default:
+			// A check is already pending.
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
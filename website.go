@@ -0,0 +1,119 @@
+package mirror2s3
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// errorDocumentKey returns the key of the error document set by
+// WithErrorDocument, or "" if there isn't one.
+func (m *Mirror) errorDocumentKey() string {
+	if m.errorDocument == "" {
+		return ""
+	}
+	return m.keyPrefix + m.errorDocument
+}
+
+// checkErrorDocument returns an error if the error document isn't one of the
+// keys Run will upload.
+func (m *Mirror) checkErrorDocument(p *plan) error {
+	key := m.errorDocumentKey()
+	if key == "" {
+		return nil
+	}
+	if _, ok := p.sizes[key]; !ok {
+		return fmt.Errorf(`error document "%s" isn't in the site`, m.errorDocument)
+	}
+	return nil
+}
+
+// checkWebsiteBucket returns an error if the website configuration is to be
+// set, but the bucket is an S3 bucket whose name isn't known. The S3 API
+// needs the name, which only the bucket URL gives, and it's better to fail
+// before uploading anything than after.
+func (m *Mirror) checkWebsiteBucket() error {
+	if !m.configWebsite || m.errorDocument == "" {
+		return nil
+	}
+	m.mu.Lock()
+	bucket := m.bucket
+	m.mu.Unlock()
+	// configureWebsite leaves buckets that aren't S3 buckets alone.
+	if bucket != nil {
+		var svc *s3.S3
+		if !bucket.As(&svc) {
+			return nil
+		}
+	} else if u, err := url.Parse(m.bucketURL); err == nil && u.Scheme != "s3" {
+		return nil
+	}
+	if _, err := s3BucketName(m.bucketURL); err != nil {
+		return fmt.Errorf("configure website: %w; the website configuration needs an s3:// bucket URL", err)
+	}
+	return nil
+}
+
+// configureWebsite points the bucket's website configuration at the error
+// document. Buckets that aren't S3 buckets with website hosting enabled are
+// left alone.
+func (r *mirrorRun) configureWebsite(ctx context.Context) error {
+	key := r.errorDocumentKey()
+	var svc *s3.S3
+	if !r.bucket.As(&svc) {
+		r.logf("warning: not setting error document, the bucket isn't an S3 bucket")
+		return nil
+	}
+
+	bucketName, err := s3BucketName(r.bucketURL)
+	if err != nil {
+		return err
+	}
+	r.countRequest(&r.res.Requests.Gets)
+	website, err := svc.GetBucketWebsiteWithContext(ctx, &s3.GetBucketWebsiteInput{Bucket: aws.String(bucketName)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchWebsiteConfiguration" {
+		r.logf("warning: not setting error document, the bucket doesn't have website hosting enabled")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get website configuration: %w", err)
+	}
+	if website.ErrorDocument != nil && aws.StringValue(website.ErrorDocument.Key) == key {
+		return nil
+	}
+	if website.RedirectAllRequestsTo != nil {
+		r.logf("warning: not setting error document, the bucket redirects all requests")
+		return nil
+	}
+
+	if r.dryRun {
+		r.logf("would set error document to %s…", key)
+		return nil
+	}
+	r.logf("setting error document to %s…", key)
+	r.countRequest(&r.res.Requests.Puts)
+	_, err = svc.PutBucketWebsiteWithContext(ctx, &s3.PutBucketWebsiteInput{
+		Bucket: aws.String(bucketName),
+		WebsiteConfiguration: &s3.WebsiteConfiguration{
+			ErrorDocument: &s3.ErrorDocument{Key: aws.String(key)},
+			IndexDocument: website.IndexDocument,
+			RoutingRules:  website.RoutingRules,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("put website configuration: %w", err)
+	}
+	return nil
+}
+
+// s3BucketName returns the name of the bucket in an s3:// URL.
+func s3BucketName(bucketURL string) (string, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", fmt.Errorf(`can't find the S3 bucket name in bucket URL "%s"`, bucketURL)
+	}
+	return u.Host, nil
+}
@@ -0,0 +1,49 @@
+package mirror2s3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/blob/s3blob"
+)
+
+func TestCheckWebsiteBucket(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opening an S3 bucket makes no requests.
+	s3Bucket, err := s3blob.OpenBucket(context.Background(), sess, "site", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3Bucket.Close()
+	memBucket := memblob.OpenBucket(nil)
+	defer memBucket.Close()
+
+	tests := []struct {
+		name      string
+		bucketURL string
+		bucket    *blob.Bucket
+		wantErr   bool
+	}{
+		{name: "S3 URL", bucketURL: "s3://site"},
+		{name: "other URL", bucketURL: "mem://"},
+		{name: "S3 bucket", bucket: s3Bucket, wantErr: true},
+		{name: "S3 bucket and URL", bucketURL: "s3://site", bucket: s3Bucket},
+		{name: "other bucket", bucket: memBucket},
+	}
+	for _, tt := range tests {
+		options := []func(*Mirror){WithErrorDocument("404.html"), WithConfigureWebsite(true), WithBucketURL(tt.bucketURL)}
+		if tt.bucket != nil {
+			options = append(options, WithBucket(tt.bucket))
+		}
+		if err := New(options...).validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate returned %v, want an error: %t", tt.name, err, tt.wantErr)
+		}
+	}
+}